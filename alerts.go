@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	b "math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// 告警条件，值大于 threshold 时触发
+const (
+	alertExpiringTiB        = "expiring_tib"         // days 天内（含今天）过期的原值算力，TiB
+	alertPenaltyFIL         = "penalty_fil"          // 全部 live 扇区现在终结的罚金，FIL
+	alertFeeRewardPct       = "fee_reward_pct"       // 日费占按当前算力估算的日收益的百分比
+	alertVestingTomorrowFIL = "vesting_tomorrow_fil" // 明天释放的锁仓，FIL
+)
+
+var alertKinds = map[string]string{
+	alertExpiringTiB:        "TiB expiring within %d days",
+	alertPenaltyFIL:         "FIL termination penalty",
+	alertFeeRewardPct:       "% of the expected daily reward paid as daily fee",
+	alertVestingTomorrowFIL: "FIL vesting tomorrow",
+}
+
+// Webhook 格式
+const (
+	alertFormatJSON     = "json"
+	alertFormatSlack    = "slack"
+	alertFormatDiscord  = "discord"
+	alertFormatTelegram = "telegram"
+)
+
+// alertRule 是一条告警规则，对每个 watch 的矿工分别判断
+type alertRule struct {
+	Name      string      `json:"name"`
+	Kind      string      `json:"kind"`
+	Days      int         `json:"days"`
+	Threshold json.Number `json:"threshold"`
+	Webhook   string      `json:"webhook"`
+	// json（默认）、slack、discord 或 telegram
+	Format string `json:"format"`
+	// telegram 的 chat_id
+	ChatID string `json:"chat_id"`
+	// 可选的 text/template 消息模板，参数为 alertEvent
+	Message string `json:"message"`
+	// 条件持续成立时重复通知的间隔，0 表示只在条件刚成立时通知一次
+	RepeatHours float64 `json:"repeat_hours"`
+
+	threshold *b.Rat
+	tmpl      *template.Template
+}
+
+// loadAlertRules 读取并检查 {"rules": [...]} 格式的规则文件
+func loadAlertRules(path string) ([]*alertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []*alertRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules", path)
+	}
+	names := make(map[string]bool)
+	for i, r := range file.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule name %s", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+func (r *alertRule) check() error {
+	if _, ok := alertKinds[r.Kind]; !ok {
+		return fmt.Errorf("unknown kind %q", r.Kind)
+	}
+	if r.Kind == alertExpiringTiB && r.Days <= 0 {
+		return fmt.Errorf("days must be positive")
+	}
+	// 阈值按十进制精确解析，与值比较时不经过浮点数
+	threshold, ok := new(b.Rat).SetString(r.Threshold.String())
+	if !ok {
+		return fmt.Errorf("invalid threshold %q", r.Threshold)
+	}
+	r.threshold = threshold
+	if r.Webhook == "" {
+		return fmt.Errorf("missing webhook")
+	}
+	switch r.Format {
+	case "":
+		r.Format = alertFormatJSON
+	case alertFormatJSON, alertFormatSlack, alertFormatDiscord:
+	case alertFormatTelegram:
+		if r.ChatID == "" {
+			return fmt.Errorf("telegram needs chat_id")
+		}
+	default:
+		return fmt.Errorf("unknown format %q", r.Format)
+	}
+	if r.Message != "" {
+		tmpl, err := template.New(r.Name).Parse(r.Message)
+		if err != nil {
+			return err
+		}
+		r.tmpl = tmpl
+	}
+	return nil
+}
+
+// alertInput 是判断规则用到的矿工数据，与 /penalty、/vested 和 /spdailyfee 的数据相同
+type alertInput struct {
+	Miner  address.Address
+	TipSet *types.TipSet
+	// live 扇区及其罚金
+	Sectors    []*calc.SectorPenalty
+	SectorSize abi.SectorSize
+	Vested     []calc.VestedDay
+	DailyFee   abi.TokenAmount
+	// 按当前算力估算的日收益，attoFIL
+	Reward abi.TokenAmount
+}
+
+func loadAlertInput(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address) (*alertInput, error) {
+	rows, ms, err := calc.SectorPenalties(ctx, lapi, ts, mid, calc.PenaltyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	vested, err := calc.VestingSchedule(ctx, lapi, ts, mid, dayStartHeight(ts.Height()), netProfile.epochsPerDay())
+	if err != nil {
+		return nil, err
+	}
+	fee, err := calc.MinerDailyFee(ctx, lapi, ts, mid)
+	if err != nil {
+		return nil, err
+	}
+	reward, err := calc.ExpectedRewardAt(ctx, lapi, ts, mid, netProfile.epochsPerDay())
+	if err != nil {
+		return nil, err
+	}
+	return &alertInput{
+		Miner:      mid,
+		TipSet:     ts,
+		Sectors:    rows,
+		SectorSize: ms.Info.SectorSize,
+		Vested:     vested,
+		DailyFee:   fee.DailyFee,
+		Reward:     reward,
+	}, nil
+}
+
+// dayEpochs 返回 ts 所在日期之后第 n 天的高度范围 [start, end)
+// 按高度而不是格式化后的日期比较，DATE_FORMAT 带时间时也能正确分天
+func dayEpochs(ts *types.TipSet, n int) (abi.ChainEpoch, abi.ChainEpoch) {
+	epd := netProfile.epochsPerDay()
+	start := dayStartHeight(ts.Height()) + abi.ChainEpoch(n)*epd
+	return start, start + epd
+}
+
+// alertValue 是规则的值，rat 用于与阈值精确比较，text 用于通知
+type alertValue struct {
+	rat  *b.Rat
+	text string
+}
+
+// filValue 把 attoFIL 转换为以 FIL 为单位的值
+func filValue(v abi.TokenAmount) alertValue {
+	return alertValue{rat: new(b.Rat).SetFrac(v.Int, b.NewInt(1e18)), text: toFIL(v)}
+}
+
+// ratioValue 是 num/denom，通知中保留 4 位小数
+func ratioValue(num, denom abi.TokenAmount) alertValue {
+	r := new(b.Rat).SetFrac(num.Int, denom.Int)
+	return alertValue{rat: r, text: r.FloatString(4)}
+}
+
+// value 返回规则在 in 上的值
+func (r *alertRule) value(in *alertInput) alertValue {
+	switch r.Kind {
+	case alertExpiringTiB:
+		from, _ := dayEpochs(in.TipSet, 0)
+		_, to := dayEpochs(in.TipSet, r.Days-1)
+		power := big.Zero()
+		for _, s := range in.Sectors {
+			if s.QuantizedExpiration >= from && s.QuantizedExpiration < to {
+				power = big.Add(power, big.NewInt(int64(in.SectorSize)))
+			}
+		}
+		return ratioValue(power, big.NewInt(1<<40))
+	case alertPenaltyFIL:
+		penalty := big.Zero()
+		for _, s := range in.Sectors {
+			penalty = big.Add(penalty, s.Penalty)
+		}
+		return filValue(penalty)
+	case alertFeeRewardPct:
+		if in.Reward.NilOrZero() {
+			return ratioValue(big.Zero(), big.NewInt(1))
+		}
+		return ratioValue(big.Mul(in.DailyFee, big.NewInt(100)), in.Reward)
+	case alertVestingTomorrowFIL:
+		from, to := dayEpochs(in.TipSet, 1)
+		vested := big.Zero()
+		for _, d := range in.Vested {
+			// 与 newVestedDays 相同，释放计入前一天
+			if d.End-1 >= from && d.End-1 < to {
+				vested = big.Add(vested, d.Vested)
+			}
+		}
+		return filValue(vested)
+	}
+	return ratioValue(big.Zero(), big.NewInt(1))
+}
+
+// alertEvent 是一次触发的告警
+type alertEvent struct {
+	Rule      string         `json:"rule"`
+	Kind      string         `json:"kind"`
+	Miner     string         `json:"miner"`
+	Value     string         `json:"value"`
+	Threshold string         `json:"threshold"`
+	Height    abi.ChainEpoch `json:"height"`
+	Message   string         `json:"message"`
+
+	rule *alertRule
+}
+
+// evaluateAlerts 返回 inputs 上成立的全部规则
+func evaluateAlerts(rules []*alertRule, inputs []*alertInput) ([]*alertEvent, error) {
+	var events []*alertEvent
+	for _, in := range inputs {
+		for _, r := range rules {
+			v := r.value(in)
+			if v.rat.Cmp(r.threshold) <= 0 {
+				continue
+			}
+			ev := &alertEvent{
+				Rule:      r.Name,
+				Kind:      r.Kind,
+				Miner:     in.Miner.String(),
+				Value:     v.text,
+				Threshold: r.Threshold.String(),
+				Height:    in.TipSet.Height(),
+				rule:      r,
+			}
+			desc := alertKinds[r.Kind]
+			if r.Kind == alertExpiringTiB {
+				desc = fmt.Sprintf(desc, r.Days)
+			}
+			ev.Message = fmt.Sprintf("[%s] %s: %s %s, above %s (height %d)", ev.Rule, ev.Miner, ev.Value, desc, ev.Threshold, ev.Height)
+			if r.tmpl != nil {
+				buf := new(bytes.Buffer)
+				if err := r.tmpl.Execute(buf, ev); err != nil {
+					return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+				}
+				ev.Message = buf.String()
+			}
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+// payload 按规则的格式生成 Webhook 请求体
+func (ev *alertEvent) payload() ([]byte, error) {
+	switch ev.rule.Format {
+	case alertFormatSlack:
+		return json.Marshal(map[string]string{"text": ev.Message})
+	case alertFormatDiscord:
+		return json.Marshal(map[string]string{"content": ev.Message})
+	case alertFormatTelegram:
+		return json.Marshal(map[string]string{"chat_id": ev.rule.ChatID, "text": ev.Message})
+	}
+	return json.Marshal(ev)
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// send 把告警 POST 到规则的 Webhook，非 2xx 返回错误
+func (ev *alertEvent) send(ctx context.Context) error {
+	body, err := ev.payload()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ev.rule.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook %s: %s %s", ev.rule.Webhook, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// computeAlerts 计算 mids 在 ts 上的数据并判断规则
+func computeAlerts(ctx context.Context, lapi ChainReader, ts *types.TipSet, mids []address.Address, rules []*alertRule) ([]*alertEvent, error) {
+	inputs, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) (*alertInput, error) {
+		return loadAlertInput(ctx, lapi, ts, mid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return evaluateAlerts(rules, inputs)
+}
+
+// alertsResult 是 alerts 子命令的输出
+func alertsResult(events []*alertEvent) *result {
+	t := &table{Header: []string{"rule", "kind", "miner", "value", "threshold", "height", "message"}}
+	for _, ev := range events {
+		t.Rows = append(t.Rows, []string{ev.Rule, ev.Kind, ev.Miner, ev.Value, ev.Threshold, strconv.FormatInt(int64(ev.Height), 10), ev.Message})
+	}
+	return &result{data: events, table: t}
+}
+
+// alertJob 定期判断 watch 中矿工的告警规则
+type alertJob struct {
+	lapi     ChainReader
+	watch    *minerQuery
+	rules    []*alertRule
+	interval time.Duration
+	// 规则名/矿工 -> 上次通知时间，条件不再成立时删除
+	fired map[string]time.Time
+}
+
+// run 每隔 interval 判断一次，直到 ctx 结束
+func (j *alertJob) run(ctx context.Context) {
+	j.fired = make(map[string]time.Time)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		if err := j.tick(ctx); err != nil {
+			log.Printf("alerts: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *alertJob) tick(ctx context.Context) error {
+	ts, err := j.lapi.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	mids, err := j.watch.resolve(ctx, j.lapi, ts)
+	if err != nil {
+		return err
+	}
+	events, err := computeAlerts(ctx, j.lapi, ts, mids, j.rules)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	active := make(map[string]bool, len(events))
+	for _, ev := range events {
+		key := ev.Rule + "/" + ev.Miner
+		active[key] = true
+		last, ok := j.fired[key]
+		if ok && (ev.rule.RepeatHours <= 0 || now.Sub(last) < time.Duration(ev.rule.RepeatHours*float64(time.Hour))) {
+			continue
+		}
+		// 发送失败时不记录，下次重试
+		if err := ev.send(ctx); err != nil {
+			log.Printf("alerts: %s: %v\n", key, err)
+			continue
+		}
+		j.fired[key] = now
+		log.Printf("alerts: sent %s\n", ev.Message)
+	}
+	for key := range j.fired {
+		if !active[key] {
+			delete(j.fired, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+// alertReceiver 是记录收到的 Webhook 请求体的 httptest 服务
+type alertReceiver struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newAlertReceiver(t *testing.T) *alertReceiver {
+	r := &alertReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.bodies = append(r.bodies, body)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestAlertsFireByEpochRange(t *testing.T) {
+	// DATE_FORMAT 带时间时，同一天的高度格式化后各不相同
+	oldFormat := dateFormat
+	dateFormat = "2006-01-02 15:04:05"
+	t.Cleanup(func() { dateFormat = oldFormat })
+
+	chain, err := newMemChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := chain.addTipSet(4900000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epd := netProfile.epochsPerDay()
+	today, _ := dayEpochs(ts, 0)
+	mid, _ := address.NewIDAddress(1155)
+
+	sector := func(expiration abi.ChainEpoch, penalty int64) *calc.SectorPenalty {
+		return &calc.SectorPenalty{QuantizedExpiration: expiration, Penalty: big.NewInt(penalty)}
+	}
+	fil := func(v int64) abi.TokenAmount { return big.Mul(big.NewInt(v), big.NewInt(1e18)) }
+	in := &alertInput{
+		Miner:  mid,
+		TipSet: ts,
+		Sectors: []*calc.SectorPenalty{
+			sector(today+100, 5e17),
+			sector(today+3*epd-1, 5e17),
+			sector(today+3*epd, 5e17),
+		},
+		SectorSize: abi.SectorSize(32 << 30),
+		Vested: []calc.VestedDay{
+			{End: today + epd, Vested: fil(7)},
+			{End: today + epd + 1, Vested: fil(2)},
+			{End: today + 2*epd, Vested: fil(3)},
+			{End: today + 2*epd + 1, Vested: fil(11)},
+		},
+		DailyFee: big.NewInt(1),
+		Reward:   big.NewInt(4),
+	}
+
+	recv := newAlertReceiver(t)
+	tests := []struct {
+		name      string
+		kind      string
+		days      int
+		threshold string
+		fire      bool
+		value     string
+	}{
+		// 今天起 3 天内过期两个 32GiB 扇区，0.0625 TiB
+		{"expiring", alertExpiringTiB, 3, "0.06", true, "0.0625"},
+		{"expiring-exact", alertExpiringTiB, 3, "0.0625", false, ""},
+		{"expiring-one-day", alertExpiringTiB, 1, "0.03", true, "0.0313"},
+		// 三个扇区的罚金共 1.5 FIL
+		{"penalty", alertPenaltyFIL, 0, "1.4999999999", true, "1.5000000000"},
+		{"penalty-exact", alertPenaltyFIL, 0, "1.5", false, ""},
+		{"fee", alertFeeRewardPct, 0, "24.9", true, "25.0000"},
+		// 明天释放 2+3 FIL，End 在明天开始的那一笔计入今天
+		{"vesting", alertVestingTomorrowFIL, 0, "4", true, "5.0000000000"},
+		{"vesting-exact", alertVestingTomorrowFIL, 0, "5", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &alertRule{Name: tt.name, Kind: tt.kind, Days: tt.days, Threshold: json.Number(tt.threshold), Webhook: recv.URL}
+			if err := rule.check(); err != nil {
+				t.Fatal(err)
+			}
+			events, err := evaluateAlerts([]*alertRule{rule}, []*alertInput{in})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.fire {
+				if len(events) != 0 {
+					t.Fatalf("fired with value %s", events[0].Value)
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			if events[0].Value != tt.value {
+				t.Fatalf("value = %s, want %s", events[0].Value, tt.value)
+			}
+			if err := events[0].send(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			recv.mu.Lock()
+			body := recv.bodies[len(recv.bodies)-1]
+			recv.mu.Unlock()
+			var got alertEvent
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("decode %s: %v", body, err)
+			}
+			if got.Rule != tt.name || got.Miner != mid.String() || got.Value != tt.value || got.Threshold != tt.threshold || got.Height != ts.Height() {
+				t.Fatalf("unexpected payload %s", body)
+			}
+		})
+	}
+}
+
+func TestAlertWebhookFormats(t *testing.T) {
+	recv := newAlertReceiver(t)
+	tests := []struct {
+		format string
+		key    string
+	}{
+		{alertFormatSlack, "text"},
+		{alertFormatDiscord, "content"},
+		{alertFormatTelegram, "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			rule := &alertRule{Name: "r", Kind: alertPenaltyFIL, Threshold: "0", Webhook: recv.URL, Format: tt.format, ChatID: "42"}
+			if err := rule.check(); err != nil {
+				t.Fatal(err)
+			}
+			ev := &alertEvent{Rule: "r", Miner: "f01155", Value: "1.5", rule: rule}
+			ev.Message = "f01155 1.5"
+			if err := ev.send(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			recv.mu.Lock()
+			body := recv.bodies[len(recv.bodies)-1]
+			recv.mu.Unlock()
+			var got map[string]string
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got[tt.key] != ev.Message {
+				t.Fatalf("payload %s has no %s message", body, tt.key)
+			}
+			if tt.format == alertFormatTelegram && got["chat_id"] != "42" {
+				t.Fatalf("payload %s has no chat_id", body)
+			}
+		})
+	}
+}
+
+func TestAlertWebhookError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	rule := &alertRule{Name: "r", Kind: alertPenaltyFIL, Threshold: "0", Webhook: srv.URL}
+	if err := rule.check(); err != nil {
+		t.Fatal(err)
+	}
+	ev := &alertEvent{Rule: "r", rule: rule}
+	if err := ev.send(context.Background()); err == nil {
+		t.Fatal("expected an error for a non-2xx response")
+	}
+}
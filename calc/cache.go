@@ -0,0 +1,169 @@
+package calc
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/sync/singleflight"
+)
+
+// stateCache 按 (tipset, 矿工) 缓存计算用到的链状态，总大小不超过 maxBytes，超出时淘汰最久未使用的
+type stateCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+
+	group singleflight.Group
+}
+
+type cacheEntry struct {
+	key   string
+	tsk   types.TipSetKey
+	value interface{}
+	size  int64
+}
+
+// cache 是所有调用共用的缓存
+var cache = newStateCache(512 << 20)
+
+// SetCacheSize 设置缓存的内存上限，0 关闭缓存
+func SetCacheSize(maxBytes int64) {
+	cache.mu.Lock()
+	cache.maxBytes = maxBytes
+	cache.mu.Unlock()
+	cache.shrink()
+}
+
+func newStateCache(maxBytes int64) *stateCache {
+	return &stateCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (sc *stateCache) enabled() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.maxBytes > 0
+}
+
+func (sc *stateCache) get(key string) (interface{}, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	el, ok := sc.items[key]
+	if !ok {
+		return nil, false
+	}
+	sc.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (sc *stateCache) add(tsk types.TipSetKey, key string, value interface{}, size int64) {
+	sc.mu.Lock()
+	if size > sc.maxBytes {
+		sc.mu.Unlock()
+		return
+	}
+	if el, ok := sc.items[key]; ok {
+		sc.remove(el)
+	}
+	sc.items[key] = sc.ll.PushFront(&cacheEntry{key: key, tsk: tsk, value: value, size: size})
+	sc.bytes += size
+	sc.mu.Unlock()
+	sc.shrink()
+}
+
+// shrink 淘汰最久未使用的缓存，直到不超过 maxBytes
+func (sc *stateCache) shrink() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for sc.bytes > sc.maxBytes && sc.ll.Len() > 0 {
+		sc.remove(sc.ll.Back())
+	}
+}
+
+func (sc *stateCache) remove(el *list.Element) {
+	e := sc.ll.Remove(el).(*cacheEntry)
+	delete(sc.items, e.key)
+	sc.bytes -= e.size
+}
+
+// dropTipSet 删除 tsk 上的所有缓存
+func (sc *stateCache) dropTipSet(tsk types.TipSetKey) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for el := sc.ll.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).tsk == tsk {
+			sc.remove(el)
+		}
+		el = next
+	}
+}
+
+// cacheLoadTimeout 是共享加载的超时，加载不随发起它的请求取消
+const cacheLoadTimeout = 10 * time.Minute
+
+// cachedLoad 从缓存读取 ts 上的 key，没有时调用 load，同一个 key 同时只会加载一次
+// 加载在不会被取消的 ctx 上进行，每个调用方只等到自己的 ctx 结束
+func cachedLoad[T any](ctx context.Context, ts *types.TipSet, key string, size func(T) int64, load func(context.Context) (T, error)) (T, error) {
+	key = ts.Key().String() + "/" + key
+	if !cache.enabled() {
+		return load(ctx)
+	}
+	if v, ok := cache.get(key); ok {
+		return v.(T), nil
+	}
+	ch := cache.group.DoChan(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheLoadTimeout)
+		defer cancel()
+		v, err := load(loadCtx)
+		if err != nil {
+			return v, err
+		}
+		cache.add(ts.Key(), key, v, size(v))
+		return v, nil
+	})
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return zero, r.Err
+		}
+		return r.Val.(T), nil
+	}
+}
+
+// WatchHead 每隔 interval 检查链头，链头变化时清掉旧链头的缓存，直到 ctx 结束
+func WatchHead(ctx context.Context, lapi ChainReader, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var head types.TipSetKey
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ts, err := lapi.ChainHead(ctx)
+		if err != nil {
+			log.Printf("watch head: %v\n", err)
+			continue
+		}
+		if ts.Key() != head {
+			if head != types.EmptyTSK {
+				cache.dropTipSet(head)
+			}
+			head = ts.Key()
+		}
+	}
+}
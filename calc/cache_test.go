@@ -0,0 +1,85 @@
+package calc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func testTipSet(t *testing.T, height abi.ChainEpoch) *types.TipSet {
+	t.Helper()
+	maddr, _ := address.NewIDAddress(1000)
+	empty, err := abi.CidBuilder.Sum([]byte{0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := types.NewTipSet([]*types.BlockHeader{{
+		Miner:                 maddr,
+		ParentWeight:          types.NewInt(0),
+		Height:                height,
+		ParentStateRoot:       empty,
+		ParentMessageReceipts: empty,
+		Messages:              empty,
+		ParentBaseFee:         types.NewInt(0),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// 发起加载的请求取消后，加载继续进行，其他等待的调用方拿到结果
+func TestCachedLoadOutlivesCaller(t *testing.T) {
+	ts := testTipSet(t, 1)
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context) (int, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		return 42, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cachedLoad(ctx, ts, "outlives", func(int) int64 { return 8 }, load)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan int, 1)
+	go func() {
+		v, err := cachedLoad(context.Background(), ts, "outlives", func(int) int64 { return 8 }, func(context.Context) (int, error) {
+			return 0, errors.New("loaded twice")
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		second <- v
+	}()
+
+	cancel()
+	select {
+	case err := <-first:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("canceled caller got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled caller is still waiting for the load")
+	}
+	close(release)
+	if v := <-second; v != 42 {
+		t.Fatalf("waiter got %d, want 42", v)
+	}
+	if v, ok := cache.get(ts.Key().String() + "/outlives"); !ok || v.(int) != 42 {
+		t.Fatalf("cached %v, %v; want 42", v, ok)
+	}
+}
@@ -0,0 +1,35 @@
+// Package calc 计算扇区终结罚金、锁仓释放和 FIP-100 日费，通过 ChainReader 读取链状态，金额均为 attoFIL
+package calc
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	apitypes "github.com/filecoin-project/lotus/api/types"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// ChainReader 是本程序用到的 lotus FullNode 接口子集
+type ChainReader interface {
+	// ChainReadObj、ChainHasObj 和 ChainPutObj，读取合约状态时使用
+	blockstore.ChainIO
+
+	ChainHead(ctx context.Context) (*types.TipSet, error)
+	ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error)
+	ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error)
+
+	StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (apitypes.NetworkVersion, error)
+	StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error)
+	StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (api.MinerInfo, error)
+	StateMinerProvingDeadline(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*dline.Info, error)
+	StateMinerPartitions(ctx context.Context, actor address.Address, dlIdx uint64, tsk types.TipSetKey) ([]api.Partition, error)
+	StateMinerSectors(ctx context.Context, actor address.Address, sectorNos *bitfield.BitField, tsk types.TipSetKey) ([]*miner.SectorOnChainInfo, error)
+	StateMinerDeadlines(ctx context.Context, actor address.Address, tsk types.TipSetKey) ([]api.Deadline, error)
+	StateVMCirculatingSupplyInternal(ctx context.Context, tsk types.TipSetKey) (api.CirculatingSupply, error)
+}
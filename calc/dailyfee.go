@@ -0,0 +1,179 @@
+package calc
+
+import (
+	"context"
+	b "math/big"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DailyFee 是全网几种 QA 算力的 FIP-100 日费，单位 attoFIL
+type DailyFee struct {
+	Qap32G   abi.TokenAmount `json:"qap_32g"`
+	Qap1T    abi.TokenAmount `json:"qap_1t"`
+	Qap100T  abi.TokenAmount `json:"qap_100t"`
+	Qap1024T abi.TokenAmount `json:"qap_1024t"`
+
+	// 计算所用的流通量
+	CirculatingSupply api.CirculatingSupply `json:"-"`
+}
+
+// MinerFee 是矿工的 FIP-100 日费和剩余总费用，单位 attoFIL
+type MinerFee struct {
+	DailyFee abi.TokenAmount `json:"daily_fee"`
+	TotalFee abi.TokenAmount `json:"total_fee"`
+
+	// live 扇区数
+	Sectors int `json:"-"`
+}
+
+// NetworkDailyFee FIP-100
+func NetworkDailyFee(ctx context.Context, lapi ChainReader, ts *types.TipSet) (*DailyFee, error) {
+	circulatingSupply, err := lapi.StateVMCirculatingSupplyInternal(ctx, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+	return &DailyFee{
+		Qap32G:            CalculateQAPFee(circulatingSupply, b.NewInt(32<<30)),
+		Qap1T:             CalculateQAPFee(circulatingSupply, b.NewInt(1<<40)),
+		Qap100T:           CalculateQAPFee(circulatingSupply, b.NewInt(100<<40)),
+		Qap1024T:          CalculateQAPFee(circulatingSupply, b.NewInt(1024<<40)),
+		CirculatingSupply: circulatingSupply,
+	}, nil
+}
+
+// CalculateQAPFee calculates the daily fee in attoFIL for a given QAP size in bytes,
+// rounded down like the miner actor does for new sectors
+func CalculateQAPFee(circulatingSupply api.CirculatingSupply, qapBytes *b.Int) abi.TokenAmount {
+	return m.DailyProofFee(circulatingSupply.FilCirculating, big.NewFromGo(qapBytes))
+}
+
+// MinerDailyFee 汇总矿工各 deadline 的日费，并按 live 扇区剩余的扣费次数计算总费用
+func MinerDailyFee(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address) (*MinerFee, error) {
+	d := &MinerFee{DailyFee: abi.NewTokenAmount(0), TotalFee: abi.NewTokenAmount(0)}
+
+	deadlines, err := lapi.StateMinerDeadlines(ctx, mid, tsk.Key())
+	if err != nil {
+		return nil, err
+	}
+	for _, deadline := range deadlines {
+		if deadline.DailyFee.NilOrZero() {
+			continue
+		}
+		d.DailyFee = big.Add(d.DailyFee, deadline.DailyFee)
+	}
+
+	ms, err := LoadMinerSectors(ctx, lapi, tsk, mid, false)
+	if err != nil {
+		return nil, err
+	}
+	d.Sectors = len(ms.Sectors)
+
+	for _, info := range ms.Sectors {
+		if info.DailyFee.NilOrZero() {
+			continue
+		}
+		dl := ms.Locations[uint64(info.SectorNumber)].Deadline
+		n := ms.FeePayments(dl, ms.QuantizedExpiration(info), tsk.Height())
+		d.TotalFee = big.Add(d.TotalFee, big.Mul(info.DailyFee, big.NewInt(n)))
+	}
+	return d, nil
+}
+
+// FeePayments 是 dl 中的扇区从 height 到 expiration（按 deadline 取整后的高度）还要扣日费的次数
+// 日费在 deadline 每个证明周期结束时扣除，ts 的状态还没有执行 height 的 cron，所以 height 本身也算；
+// 扇区在过期的那次 deadline 结束时先被移除，不再扣费
+func (ms *MinerSectors) FeePayments(dl uint64, expiration, height abi.ChainEpoch) int64 {
+	first := ms.Quantize(dl, height)
+	if expiration <= first {
+		return 0
+	}
+	return int64((ms.Quantize(dl, expiration) - first) / m.WPoStProvingPeriod)
+}
+
+// FeeDay 是某一天预计扣除的日费
+type FeeDay struct {
+	Day string
+	// 当天扣费的扇区数
+	Sectors int
+	Fee     abi.TokenAmount
+}
+
+// FeeOutflow 逐个 deadline 展开 ms 中扇区从 epoch 起每次扣除的日费，按 dayOf(扣费高度) 汇总，直到最后一个扇区过期
+// 各天之和等于扇区 RemainingFee 之和；dayOf 返回的字符串按字典序排序
+func (ms *MinerSectors) FeeOutflow(epoch abi.ChainEpoch, dayOf func(abi.ChainEpoch) string) []*FeeDay {
+	// 每个 deadline 中按剩余扣费次数汇总
+	type payments struct {
+		sectors int
+		fee     abi.TokenAmount
+	}
+	byDeadline := make(map[uint64]map[int64]*payments)
+	for _, info := range ms.Sectors {
+		if info.DailyFee.NilOrZero() {
+			continue
+		}
+		dl := ms.Locations[uint64(info.SectorNumber)].Deadline
+		n := ms.FeePayments(dl, ms.QuantizedExpiration(info), epoch)
+		if n == 0 {
+			continue
+		}
+		if byDeadline[dl] == nil {
+			byDeadline[dl] = make(map[int64]*payments)
+		}
+		p, ok := byDeadline[dl][n]
+		if !ok {
+			p = &payments{fee: big.Zero()}
+			byDeadline[dl][n] = p
+		}
+		p.sectors++
+		p.fee = big.Add(p.fee, info.DailyFee)
+	}
+
+	byDay := make(map[string]*FeeDay)
+	for dl, counts := range byDeadline {
+		var last int64
+		for n := range counts {
+			if n > last {
+				last = n
+			}
+		}
+		// 第 k 次扣费的是剩余次数大于 k 的扇区，从最后一次往前累加
+		first := ms.Quantize(dl, epoch)
+		sectors, fee := 0, big.Zero()
+		for k := last - 1; k >= 0; k-- {
+			if p, ok := counts[k+1]; ok {
+				sectors += p.sectors
+				fee = big.Add(fee, p.fee)
+			}
+			day := dayOf(first + abi.ChainEpoch(k)*m.WPoStProvingPeriod)
+			d, ok := byDay[day]
+			if !ok {
+				d = &FeeDay{Day: day, Fee: big.Zero()}
+				byDay[day] = d
+			}
+			d.Sectors += sectors
+			d.Fee = big.Add(d.Fee, fee)
+		}
+	}
+	days := make([]*FeeDay, 0, len(byDay))
+	for _, d := range byDay {
+		days = append(days, d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	return days
+}
+
+// AttoToFIL 把 attoFIL 转换为 FIL 浮点数，会丢失精度，只用于 Prometheus 指标这类只接受浮点数的地方
+func AttoToFIL(v abi.TokenAmount) float64 {
+	if v.NilOrZero() {
+		return 0
+	}
+	f, _ := new(b.Rat).SetFrac(v.Int, b.NewInt(1e18)).Float64()
+	return f
+}
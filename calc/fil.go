@@ -0,0 +1,82 @@
+package calc
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// Rounding 是把 attoFIL 格式化为 FIL 小数时的舍入方式
+type Rounding string
+
+const (
+	// RoundDown 向零截断
+	RoundDown Rounding = "down"
+	// RoundUp 远离零进位
+	RoundUp Rounding = "up"
+	// RoundHalfUp 四舍五入，.5 远离零进位，与 big.Rat.FloatString 相同
+	RoundHalfUp Rounding = "half-up"
+	// RoundHalfEven 银行家舍入，.5 舍入到偶数
+	RoundHalfEven Rounding = "half-even"
+)
+
+// ParseRounding 解析舍入方式
+func ParseRounding(s string) (Rounding, error) {
+	switch r := Rounding(strings.ToLower(s)); r {
+	case RoundDown, RoundUp, RoundHalfUp, RoundHalfEven:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown rounding %s, use down, up, half-up or half-even", s)
+}
+
+// FormatFIL 把 attoFIL 格式化为保留 precision 位小数的 FIL，precision 不小于 18 时是精确值
+func FormatFIL(v abi.TokenAmount, precision int, mode Rounding) string {
+	if precision < 0 {
+		precision = 0
+	}
+	atto := new(big.Int)
+	if !v.Nil() {
+		atto.Abs(v.Int)
+	}
+	neg := !v.Nil() && v.Sign() < 0
+
+	// 按 precision 缩放后的整数
+	q := new(big.Int)
+	if precision >= 18 {
+		q.Mul(atto, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision-18)), nil))
+	} else {
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(18-precision)), nil)
+		r := new(big.Int)
+		q.QuoRem(atto, scale, r)
+		if r.Sign() != 0 && roundAway(mode, q, new(big.Int).Lsh(r, 1).Cmp(scale)) {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+
+	s := q.String()
+	if precision > 0 {
+		if len(s) <= precision {
+			s = strings.Repeat("0", precision-len(s)+1) + s
+		}
+		s = s[:len(s)-precision] + "." + s[len(s)-precision:]
+	}
+	if neg && q.Sign() != 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// roundAway 判断截断后的 q 是否需要远离零进位，half 是两倍余数与除数的比较结果
+func roundAway(mode Rounding, q *big.Int, half int) bool {
+	switch mode {
+	case RoundUp:
+		return true
+	case RoundHalfUp:
+		return half >= 0
+	case RoundHalfEven:
+		return half > 0 || half == 0 && q.Bit(0) == 1
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package calc
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+func TestFormatFIL(t *testing.T) {
+	atto := func(s string) abi.TokenAmount {
+		v, err := big.FromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name      string
+		v         abi.TokenAmount
+		precision int
+		mode      Rounding
+		want      string
+	}{
+		{"down", atto("1234567890123456789"), 4, RoundDown, "1.2345"},
+		{"up", atto("1234567890123456789"), 4, RoundUp, "1.2346"},
+		{"half-up", atto("1234567890123456789"), 4, RoundHalfUp, "1.2346"},
+		{"half-even", atto("1234567890123456789"), 4, RoundHalfEven, "1.2346"},
+		// 恰好一半
+		{"tie-half-up", atto("1000050000000000000"), 4, RoundHalfUp, "1.0001"},
+		{"tie-half-even-down", atto("1000050000000000000"), 4, RoundHalfEven, "1.0000"},
+		{"tie-half-even-up", atto("1000150000000000000"), 4, RoundHalfEven, "1.0002"},
+		{"tie-down", atto("1000050000000000000"), 4, RoundDown, "1.0000"},
+		{"integer-half-even", atto("2500000000000000000"), 0, RoundHalfEven, "2"},
+		{"integer-half-up", atto("2500000000000000000"), 0, RoundHalfUp, "3"},
+		// 负数按绝对值舍入
+		{"negative-half-up", atto("-1000050000000000000"), 4, RoundHalfUp, "-1.0001"},
+		{"negative-down", atto("-1000050000000000000"), 4, RoundDown, "-1.0000"},
+		{"negative-to-zero", atto("-1"), 4, RoundDown, "0.0000"},
+		{"one-atto-up", atto("1"), 4, RoundUp, "0.0001"},
+		// 18 位及以上是精确值
+		{"exact", atto("1234567890123456789"), 18, RoundDown, "1.234567890123456789"},
+		{"exact-padded", atto("1234567890123456789"), 20, RoundDown, "1.23456789012345678900"},
+		{"small-exact", atto("5"), 18, RoundDown, "0.000000000000000005"},
+		{"large", atto("123456789000000000000000000"), 2, RoundDown, "123456789.00"},
+		{"nil", abi.TokenAmount{}, 4, RoundHalfUp, "0.0000"},
+		{"negative-precision", atto("1500000000000000000"), -1, RoundHalfUp, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatFIL(tt.v, tt.precision, tt.mode); got != tt.want {
+				t.Fatalf("FormatFIL(%s, %d, %s) = %s, want %s", tt.v, tt.precision, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRounding(t *testing.T) {
+	for _, s := range []string{"down", "UP", "half-up", "Half-Even"} {
+		if _, err := ParseRounding(s); err != nil {
+			t.Errorf("ParseRounding(%s): %v", s, err)
+		}
+	}
+	if _, err := ParseRounding("bankers"); err == nil {
+		t.Error("expected an error for an unknown rounding")
+	}
+}
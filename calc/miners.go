@@ -0,0 +1,282 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	init_ "github.com/filecoin-project/lotus/chain/actors/builtin/init"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+// ResolveID 把地址转换为 ID 地址
+func ResolveID(ctx context.Context, lapi ChainReader, ts *types.TipSet, addr address.Address) (address.Address, error) {
+	if addr.Protocol() == address.ID {
+		return addr, nil
+	}
+	act, err := lapi.StateGetActor(ctx, init_.Address, ts.Key())
+	if err != nil {
+		return address.Undef, err
+	}
+	st, err := init_.Load(stateStore(ctx, lapi), act)
+	if err != nil {
+		return address.Undef, err
+	}
+	id, found, err := st.ResolveAddress(addr)
+	if err != nil {
+		return address.Undef, err
+	}
+	if !found {
+		return address.Undef, fmt.Errorf("address %s not found", addr)
+	}
+	return id, nil
+}
+
+// minerIndexTTL 是 owner 索引可以复用的高度范围，超过后重建
+const minerIndexTTL = abi.ChainEpoch(2880)
+
+// minerIndex 是 owner/worker 到矿工的索引，在 height 建立，之后 minerIndexTTL 个高度内的 tipset 都复用它
+var minerIndex struct {
+	sync.Mutex
+	height abi.ChainEpoch
+	owned  map[address.Address][]address.Address
+
+	group singleflight.Group
+}
+
+// MinersOf 返回 owner 或 worker 为 addr、仍有锁仓（质押、预提交押金或未释放的奖励）的矿工，按 ID 排序
+// 没有算力的矿工只要还有锁仓也会返回；索引最多一天重建一次，期间新建或转手的矿工要等重建后才会出现
+func MinersOf(ctx context.Context, lapi ChainReader, ts *types.TipSet, addr address.Address) ([]address.Address, error) {
+	id, err := ResolveID(ctx, lapi, ts, addr)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := ownerIndex(ctx, lapi, ts)
+	if err != nil {
+		return nil, err
+	}
+	// 索引可能是之前的高度建立的，按 ts 时的状态再确认一次
+	ok, err := MapMiners(ctx, owned[id], func(ctx context.Context, mid address.Address) (bool, error) {
+		return controlsMiner(ctx, lapi, ts, id, mid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mids []address.Address
+	for i, mid := range owned[id] {
+		if ok[i] {
+			mids = append(mids, mid)
+		}
+	}
+	if len(mids) == 0 {
+		return nil, fmt.Errorf("no miner with locked funds is owned or operated by %s", addr)
+	}
+	return mids, nil
+}
+
+// ownerIndex 返回可用于 ts 的 owner 索引，ts 在索引之前或超过 minerIndexTTL 时重建
+// 比索引更早的 tipset 可能还没有索引中的矿工，单独按 tipset 建立并缓存，不替换链头附近的索引
+func ownerIndex(ctx context.Context, lapi ChainReader, ts *types.TipSet) (map[address.Address][]address.Address, error) {
+	minerIndex.Lock()
+	owned, height := minerIndex.owned, minerIndex.height
+	minerIndex.Unlock()
+	if owned != nil && ts.Height() >= height && ts.Height()-height <= minerIndexTTL {
+		return owned, nil
+	}
+	if owned != nil && ts.Height() < height {
+		return cachedLoad(ctx, ts, "miners", func(m map[address.Address][]address.Address) int64 { return int64(len(m)) * 128 }, func(ctx context.Context) (map[address.Address][]address.Address, error) {
+			return fetchMinersByController(ctx, lapi, ts)
+		})
+	}
+
+	// 扫描算力合约时不持有锁，同一个 tipset 只扫描一次，建好后再替换索引
+	ch := minerIndex.group.DoChan(ts.Key().String(), func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheLoadTimeout)
+		defer cancel()
+		owned, err := fetchMinersByController(loadCtx, lapi, ts)
+		if err != nil {
+			return nil, err
+		}
+		minerIndex.Lock()
+		// 同时在重建的更高的 tipset 已经替换过索引时保留它
+		if minerIndex.owned == nil || ts.Height() >= minerIndex.height {
+			minerIndex.height = ts.Height()
+			minerIndex.owned = owned
+		}
+		minerIndex.Unlock()
+		return owned, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.(map[address.Address][]address.Address), nil
+	}
+}
+
+// controlsMiner 判断 ts 时 id 是否仍是 mid 的 owner 或 worker，并且 mid 还有锁仓
+func controlsMiner(ctx context.Context, lapi ChainReader, ts *types.TipSet, id, mid address.Address) (bool, error) {
+	mas, err := LoadMinerState(ctx, lapi, ts, mid)
+	if err != nil {
+		return false, err
+	}
+	info, err := mas.Info()
+	if err != nil {
+		return false, fmt.Errorf("miner %s info: %w", mid, err)
+	}
+	if info.Owner != id && info.Worker != id {
+		return false, nil
+	}
+	locked, err := mas.LockedFunds()
+	if err != nil {
+		return false, fmt.Errorf("miner %s locked funds: %w", mid, err)
+	}
+	return locked.TotalLockedFunds().GreaterThan(big.Zero()), nil
+}
+
+// fetchMinersByController 读取存储算力合约中的全部矿工（包括没有算力的），按 owner 和 worker 分组
+func fetchMinersByController(ctx context.Context, lapi ChainReader, ts *types.TipSet) (map[address.Address][]address.Address, error) {
+	act, err := lapi.StateGetActor(ctx, power.Address, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+	pst, err := power.Load(stateStore(ctx, lapi), act)
+	if err != nil {
+		return nil, err
+	}
+	mids, err := pst.ListAllMiners()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	owned := make(map[address.Address][]address.Address)
+	_, err = MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) (struct{}, error) {
+		mas, err := LoadMinerState(ctx, lapi, ts, mid)
+		if err != nil {
+			return struct{}{}, err
+		}
+		info, err := mas.Info()
+		if err != nil {
+			return struct{}{}, fmt.Errorf("miner %s info: %w", mid, err)
+		}
+		mu.Lock()
+		owned[info.Owner] = append(owned[info.Owner], mid)
+		if info.Worker != info.Owner {
+			owned[info.Worker] = append(owned[info.Worker], mid)
+		}
+		mu.Unlock()
+		return struct{}{}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ms := range owned {
+		sort.Slice(ms, func(i, j int) bool {
+			a, _ := address.IDFromAddress(ms[i])
+			b, _ := address.IDFromAddress(ms[j])
+			return a < b
+		})
+	}
+	return owned, nil
+}
+
+// MapMiners 并发对每个矿工调用 fn，结果与 mids 顺序相同，任意一个出错则返回错误
+func MapMiners[T any](ctx context.Context, mids []address.Address, fn func(ctx context.Context, mid address.Address) (T, error)) ([]T, error) {
+	out := make([]T, len(mids))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(stateWorkers)
+	for i, mid := range mids {
+		g.Go(func() error {
+			v, err := fn(gctx, mid)
+			if err != nil {
+				return fmt.Errorf("%s: %w", mid, err)
+			}
+			out[i] = v
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MergeExpirationDays 把多个矿工的过期日历按日期合并
+func MergeExpirationDays(lists ...[]*ExpirationDay) []*ExpirationDay {
+	byDay := make(map[string]*ExpirationDay)
+	for _, days := range lists {
+		for _, d := range days {
+			m, ok := byDay[d.Day]
+			if !ok {
+				m = &ExpirationDay{Day: d.Day, Power: big.Zero(), Pledge: big.Zero(), Penalty: big.Zero(), DailyFee: big.Zero(), RemainingFee: big.Zero()}
+				byDay[d.Day] = m
+			}
+			m.Sectors += d.Sectors
+			m.Power = big.Add(m.Power, d.Power)
+			m.Pledge = big.Add(m.Pledge, d.Pledge)
+			m.Penalty = big.Add(m.Penalty, d.Penalty)
+			m.DailyFee = big.Add(m.DailyFee, d.DailyFee)
+			m.RemainingFee = big.Add(m.RemainingFee, d.RemainingFee)
+		}
+	}
+	merged := make([]*ExpirationDay, 0, len(byDay))
+	for _, d := range byDay {
+		merged = append(merged, d)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Day < merged[j].Day })
+	return merged
+}
+
+// MergeFeeDays 把多个矿工的日费支出按日期合并
+func MergeFeeDays(lists ...[]*FeeDay) []*FeeDay {
+	byDay := make(map[string]*FeeDay)
+	for _, days := range lists {
+		for _, d := range days {
+			m, ok := byDay[d.Day]
+			if !ok {
+				m = &FeeDay{Day: d.Day, Fee: big.Zero()}
+				byDay[d.Day] = m
+			}
+			m.Sectors += d.Sectors
+			m.Fee = big.Add(m.Fee, d.Fee)
+		}
+	}
+	merged := make([]*FeeDay, 0, len(byDay))
+	for _, d := range byDay {
+		merged = append(merged, d)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Day < merged[j].Day })
+	return merged
+}
+
+// MergeVestingSchedules 把多个矿工的释放计划按高度合并
+func MergeVestingSchedules(schedules ...[]VestedDay) []VestedDay {
+	byEnd := make(map[int64]*VestedDay)
+	for _, days := range schedules {
+		for _, d := range days {
+			m, ok := byEnd[int64(d.End)]
+			if !ok {
+				m = &VestedDay{End: d.End, Vested: big.Zero()}
+				byEnd[int64(d.End)] = m
+			}
+			m.Vested = big.Add(m.Vested, d.Vested)
+		}
+	}
+	merged := make([]VestedDay, 0, len(byEnd))
+	for _, d := range byEnd {
+		merged = append(merged, *d)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].End < merged[j].End })
+	return merged
+}
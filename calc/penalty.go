@@ -0,0 +1,176 @@
+package calc
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	s "github.com/filecoin-project/go-state-types/builtin/v16/util/smoothing"
+	gststore "github.com/filecoin-project/go-state-types/store"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/builtin"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/reward"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// https://github.com/filecoin-project/FIPs/blob/master/FIPS/fip-0098.md#specification
+const (
+	// TerminationLifetimeCap 是计入终结罚金的扇区年龄上限（天）
+	TerminationLifetimeCap = 140
+
+	termFeePledgeMultipleNum   = 85
+	termFeePledgeMultipleDenom = 1000
+
+	termFeeMinPledgeMultipleNum   = 2
+	termFeeMinPledgeMultipleDenom = 100
+
+	termFeeMaxFaultFeeMultipleNum   = 105
+	termFeeMaxFaultFeeMultipleDenom = 100
+)
+
+// 终止费中起决定作用的项
+const (
+	TermDuration      = "duration"        // 按扇区年龄计算的 8.5% 质押
+	TermPledgeFloor   = "pledge_floor"    // 2% 质押的下限
+	TermFaultFeeFloor = "fault_fee_floor" // 105% fault fee 的下限
+	TermLegacy        = "legacy"          // nv25 之前的公式
+)
+
+// SectorTerminationFee 计算扇区在 epoch 终结时的罚金，同时返回 fault fee 和起决定作用的项
+func SectorTerminationFee(policy TerminationFeePolicy, epoch abi.ChainEpoch, size abi.SectorSize, info *miner.SectorOnChainInfo, rewardEstimate, networkQAPowerEstimate s.FilterEstimate) (abi.TokenAmount, abi.TokenAmount, string) {
+	faultFee := FaultFee(size, info, rewardEstimate, networkQAPowerEstimate)
+	penalty, term := policy.Fee(epoch, info, faultFee)
+	return penalty, faultFee, term
+}
+
+// copy from builtin-actors
+func PledgePenaltyForTermination(initialPledge abi.TokenAmount, sectorAge int64, faultFee abi.TokenAmount) abi.TokenAmount {
+	fee, _ := pledgePenaltyForTerminationTerm(initialPledge, sectorAge, faultFee)
+	return fee
+}
+
+// pledgePenaltyForTerminationTerm 与 PledgePenaltyForTermination 相同，额外返回起决定作用的项
+func pledgePenaltyForTerminationTerm(initialPledge abi.TokenAmount, sectorAge int64, faultFee abi.TokenAmount) (abi.TokenAmount, string) {
+	simpleTerminationFee := big.Div(big.Mul(initialPledge, big.NewInt(termFeePledgeMultipleNum)), big.NewInt(termFeePledgeMultipleDenom))
+	durationTerminationFee := big.Div(big.Mul(big.NewInt(sectorAge), simpleTerminationFee), big.NewInt(TerminationLifetimeCap*builtin.EpochsInDay))
+	baseTerminationFee := big.Min(simpleTerminationFee, durationTerminationFee)
+
+	minimumFeeAbs := big.Div(big.Mul(initialPledge, big.NewInt(termFeeMinPledgeMultipleNum)), big.NewInt(termFeeMinPledgeMultipleDenom))
+	minimumFeeFF := big.Div(big.Mul(faultFee, big.NewInt(termFeeMaxFaultFeeMultipleNum)), big.NewInt(termFeeMaxFaultFeeMultipleDenom))
+	minimumFee := big.Max(minimumFeeAbs, minimumFeeFF)
+
+	switch {
+	case baseTerminationFee.GreaterThanEqual(minimumFee):
+		return baseTerminationFee, TermDuration
+	case minimumFeeFF.GreaterThan(minimumFeeAbs):
+		return minimumFeeFF, TermFaultFeeFloor
+	default:
+		return minimumFeeAbs, TermPledgeFloor
+	}
+}
+
+// pub const CONTINUED_FAULT_PROJECTION_PERIOD: ChainEpoch = (EPOCHS_IN_DAY * CONTINUED_FAULT_FACTOR_NUM) / CONTINUED_FAULT_FACTOR_DENOM;
+// 3.51 * dayward
+func FaultFee(size abi.SectorSize, info *m.SectorOnChainInfo, rewardEstimate s.FilterEstimate, networkQAPowerEstimate s.FilterEstimate) abi.TokenAmount {
+	qaPower := m.QAPowerForSector(size, info)
+	return FaultFeeForPower(qaPower, rewardEstimate, networkQAPowerEstimate)
+}
+
+// FaultFeeForPower 返回 qaPower 的 fault fee
+func FaultFeeForPower(qaPower abi.StoragePower, rewardEstimate, networkQAPowerEstimate s.FilterEstimate) abi.TokenAmount {
+	return m.ExpectedRewardForPower(rewardEstimate, networkQAPowerEstimate, qaPower, 10108)
+}
+
+// FaultFeeAt 返回 ts 时 qaPower 的 fault fee
+func FaultFeeAt(ctx context.Context, lapi ChainReader, ts *types.TipSet, qaPower abi.StoragePower) (abi.TokenAmount, error) {
+	rewardEstimate, networkQAPowerEstimate, err := GetSmoothing(ctx, lapi, ts)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	return FaultFeeForPower(qaPower, rewardEstimate, networkQAPowerEstimate), nil
+}
+
+// ExpectedRewardAt 返回矿工按 ts 时的 QA 算力在 epochs 个高度内的预期区块奖励，没有算力时为 0
+func ExpectedRewardAt(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address, epochs abi.ChainEpoch) (abi.TokenAmount, error) {
+	act, err := lapi.StateGetActor(ctx, power.Address, ts.Key())
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	pst, err := power.Load(stateStore(ctx, lapi), act)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	claim, found, err := pst.MinerPower(mid)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	if !found {
+		return big.Zero(), nil
+	}
+	rewardEstimate, networkQAPowerEstimate, err := GetSmoothing(ctx, lapi, ts)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+	return m.ExpectedRewardForPower(rewardEstimate, networkQAPowerEstimate, claim.QualityAdjPower, epochs), nil
+}
+
+// GetSmoothing 返回 ts 时区块奖励和全网 QA 算力的平滑估计
+func GetSmoothing(ctx context.Context, lapi ChainReader, ts *types.TipSet) (s.FilterEstimate, s.FilterEstimate, error) {
+	v, err := cachedLoad(ctx, ts, "smoothing", func([2]s.FilterEstimate) int64 { return 512 }, func(ctx context.Context) ([2]s.FilterEstimate, error) {
+		reward, power, err := fetchSmoothing(ctx, lapi, ts)
+		return [2]s.FilterEstimate{reward, power}, err
+	})
+	return v[0], v[1], err
+}
+
+// fetchSmoothing 读取奖励和全网算力的平滑估计
+func fetchSmoothing(ctx context.Context, lapi ChainReader, ts *types.TipSet) (s.FilterEstimate, s.FilterEstimate, error) {
+	bs := blockstore.NewAPIBlockstore(lapi)
+	ctxStore := gststore.WrapBlockStore(ctx, bs)
+
+	powerActor, err := lapi.StateGetActor(ctx, power.Address, ts.Key())
+	if err != nil {
+		return s.FilterEstimate{}, s.FilterEstimate{}, err
+	}
+
+	powerState, err := power.Load(ctxStore, powerActor)
+	if err != nil {
+		return s.FilterEstimate{}, s.FilterEstimate{}, err
+	}
+
+	rewardActor, err := lapi.StateGetActor(ctx, reward.Address, ts.Key())
+	if err != nil {
+		return s.FilterEstimate{}, s.FilterEstimate{}, err
+	}
+
+	rewardState, err := reward.Load(ctxStore, rewardActor)
+	if err != nil {
+		return s.FilterEstimate{}, s.FilterEstimate{}, err
+	}
+
+	networkQAPower, err := powerState.TotalPowerSmoothed()
+	if err != nil {
+		return s.FilterEstimate{}, s.FilterEstimate{}, err
+	}
+
+	thisEpochRewardSmoothed, err := rewardState.(interface {
+		ThisEpochRewardSmoothed() (builtin.FilterEstimate, error)
+	}).ThisEpochRewardSmoothed()
+	if err != nil {
+		return s.FilterEstimate{}, s.FilterEstimate{}, err
+	}
+
+	rewardEstimate := s.FilterEstimate{
+		PositionEstimate: thisEpochRewardSmoothed.PositionEstimate,
+		VelocityEstimate: thisEpochRewardSmoothed.VelocityEstimate,
+	}
+	networkQAPowerEstimate := s.FilterEstimate{
+		PositionEstimate: networkQAPower.PositionEstimate,
+		VelocityEstimate: networkQAPower.VelocityEstimate,
+	}
+	return rewardEstimate, networkQAPowerEstimate, nil
+}
@@ -0,0 +1,140 @@
+package calc
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+)
+
+// milliFIL 返回 v 个千分之一 FIL 的 attoFIL
+func milliFIL(v int64) abi.TokenAmount {
+	return big.Mul(big.NewInt(v), big.NewInt(1e15))
+}
+
+func TestPledgePenaltyForTermination(t *testing.T) {
+	pledge := milliFIL(100000)
+	tests := []struct {
+		name     string
+		age      int64
+		faultFee abi.TokenAmount
+		want     abi.TokenAmount
+		term     string
+	}{
+		// 8.5% 质押按年龄线性增长
+		{"duration", TerminationLifetimeCap * 2880 / 2, milliFIL(1000), milliFIL(4250), TermDuration},
+		{"duration-capped", TerminationLifetimeCap * 2880 * 2, milliFIL(1000), milliFIL(8500), TermDuration},
+		// 年轻扇区至少 2% 质押
+		{"pledge-floor", 2880, milliFIL(1000), milliFIL(2000), TermPledgeFloor},
+		{"pledge-floor-new", 0, big.Zero(), milliFIL(2000), TermPledgeFloor},
+		// 也至少 105% fault fee
+		{"fault-fee-floor", 2880, milliFIL(10000), milliFIL(10500), TermFaultFeeFloor},
+		{"fault-fee-over-duration", TerminationLifetimeCap * 2880, milliFIL(9000), milliFIL(9450), TermFaultFeeFloor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, term := pledgePenaltyForTerminationTerm(pledge, tt.age, tt.faultFee)
+			if !got.Equals(tt.want) || term != tt.term {
+				t.Fatalf("got %s (%s), want %s (%s)", got, term, tt.want, tt.term)
+			}
+			if fee := PledgePenaltyForTermination(pledge, tt.age, tt.faultFee); !fee.Equals(tt.want) {
+				t.Fatalf("PledgePenaltyForTermination = %s, want %s", fee, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminationPolicies(t *testing.T) {
+	const activation = abi.ChainEpoch(1000000)
+	sector := func(powerBase abi.ChainEpoch, replaced abi.TokenAmount) *miner.SectorOnChainInfo {
+		dayReward, storagePledge := milliFIL(200), milliFIL(4000)
+		return &miner.SectorOnChainInfo{
+			Activation:            activation,
+			PowerBaseEpoch:        powerBase,
+			InitialPledge:         milliFIL(100000),
+			ExpectedDayReward:     &dayReward,
+			ExpectedStoragePledge: &storagePledge,
+			ReplacedDayReward:     &replaced,
+		}
+	}
+	fip0098Fee := big.NewInt(6071428571428571428)
+
+	tests := []struct {
+		name     string
+		nv       network.Version
+		info     *miner.SectorOnChainInfo
+		epoch    abi.ChainEpoch
+		want     abi.TokenAmount
+		term     string
+		ageStart abi.ChainEpoch
+	}{
+		// 激活 100 天：4 + 0.2*100/2 FIL
+		{"legacy", network.Version24, sector(activation, big.Zero()), activation + 100*2880, milliFIL(14000), TermLegacy, activation},
+		// 第 50 天续期：续期前后的日奖励各算 50 天
+		{"legacy-replaced", network.Version24, sector(activation+50*2880, milliFIL(100)), activation + 100*2880, milliFIL(11500), TermLegacy, activation + 50*2880},
+		{"legacy-before-activation", network.Version24, sector(activation, big.Zero()), activation - 1, milliFIL(4000), TermLegacy, activation},
+		// FIP-0098：8.5% 质押 * 100/140，续期不影响年龄
+		{"fip0098", network.Version25, sector(activation, big.Zero()), activation + 100*2880, fip0098Fee, TermDuration, activation},
+		{"fip0098-replaced", network.Version25, sector(activation+50*2880, milliFIL(100)), activation + 100*2880, fip0098Fee, TermDuration, activation},
+		{"fip0098-later-version", network.Version26, sector(activation, big.Zero()), activation + 100*2880, fip0098Fee, TermDuration, activation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := TerminationPolicyFor(tt.nv)
+			got, term := policy.Fee(tt.epoch, tt.info, milliFIL(1000))
+			if !got.Equals(tt.want) || term != tt.term {
+				t.Fatalf("got %s (%s), want %s (%s)", got, term, tt.want, tt.term)
+			}
+			if start := policy.AgeStart(tt.info); start != tt.ageStart {
+				t.Fatalf("AgeStart = %d, want %d", start, tt.ageStart)
+			}
+		})
+	}
+}
+
+func TestTerminationPolicySegments(t *testing.T) {
+	const activation = abi.ChainEpoch(1000000)
+	sector := func(powerBase abi.ChainEpoch, pledge, replaced abi.TokenAmount) *miner.SectorOnChainInfo {
+		dayReward, storagePledge := big.Div(pledge, big.NewInt(500)), big.Div(pledge, big.NewInt(25))
+		return &miner.SectorOnChainInfo{
+			Activation:            activation,
+			PowerBaseEpoch:        powerBase,
+			InitialPledge:         pledge,
+			ExpectedDayReward:     &dayReward,
+			ExpectedStoragePledge: &storagePledge,
+			ReplacedDayReward:     &replaced,
+		}
+	}
+	sectors := map[string]*miner.SectorOnChainInfo{
+		"new":             sector(activation, milliFIL(100000), big.Zero()),
+		"replaced":        sector(activation+50*2880, milliFIL(100000), milliFIL(100)),
+		"replaced-late":   sector(activation+200*2880, milliFIL(3333), milliFIL(7)),
+		"tiny-pledge":     sector(activation, big.NewInt(11), big.Zero()),
+		"odd-pledge":      sector(activation, big.NewInt(123456789012345), big.Zero()),
+		"replaced-capped": sector(activation+500*2880, big.NewInt(987654321), big.NewInt(1234)),
+	}
+	for _, nv := range []network.Version{network.Version24, network.Version25} {
+		policy := TerminationPolicyFor(nv)
+		for name, info := range sectors {
+			segs := policy.Segments(info)
+			epochs := []abi.ChainEpoch{activation - 1}
+			for e := activation - 10*2880; e < activation+800*2880; e += 997 {
+				epochs = append(epochs, e)
+			}
+			for _, seg := range segs[1:] {
+				epochs = append(epochs, seg.Start-1, seg.Start, seg.Start+1)
+			}
+			for _, ff := range []abi.TokenAmount{big.Zero(), milliFIL(1), milliFIL(5000)} {
+				for _, epoch := range epochs {
+					want, _ := policy.Fee(epoch, info, ff)
+					got := big.Max(SegmentAt(segs, epoch).At(epoch), policy.FaultFeeFloor(ff))
+					if !got.Equals(want) {
+						t.Fatalf("nv%d %s: fee at %d with fault fee %s = %s, want %s", nv, name, epoch, ff, got, want)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/chain/actors/builtin"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// TerminationFeePolicy 是某个网络版本下矿工合约计算终结罚金的规则
+// 新的罚金 FIP 作为新的规则加入 terminationPolicies，不在调用方增加分支
+type TerminationFeePolicy interface {
+	// Fee 返回扇区在 epoch 终结时的罚金和起决定作用的项
+	Fee(epoch abi.ChainEpoch, info *miner.SectorOnChainInfo, faultFee abi.TokenAmount) (abi.TokenAmount, string)
+	// AgeStart 返回计算扇区年龄的起点
+	AgeStart(info *miner.SectorOnChainInfo) abi.ChainEpoch
+	// Segments 把不考虑 fault fee 下限时的罚金拆成按高度排列的分段
+	Segments(info *miner.SectorOnChainInfo) []FeeSegment
+	// FaultFeeFloor 返回 fault fee 对应的罚金下限，Fee 等于所在分段的值与它的较大者
+	FaultFeeFloor(faultFee abi.TokenAmount) abi.TokenAmount
+}
+
+// FeeSegment 是罚金的一段，在 [Start, 下一段的 Start) 内
+// 罚金 = Base + floor((Num + Slope*(epoch-Start)) / Denom)
+// 第一段的 Start 为 math.MinInt64，且 Slope 为 0
+type FeeSegment struct {
+	Start abi.ChainEpoch
+	Base  abi.TokenAmount
+	Num   big.Int
+	Slope big.Int
+	Denom int64
+}
+
+// At 返回 epoch 时这一段的罚金
+func (fs FeeSegment) At(epoch abi.ChainEpoch) abi.TokenAmount {
+	num := fs.Num
+	if !fs.Slope.IsZero() {
+		num = big.Add(num, big.Mul(fs.Slope, big.NewInt(int64(epoch-fs.Start))))
+	}
+	if num.IsZero() {
+		return fs.Base
+	}
+	return big.Add(fs.Base, big.Div(num, big.NewInt(fs.Denom)))
+}
+
+// SegmentAt 返回 segs 中包含 epoch 的一段
+func SegmentAt(segs []FeeSegment, epoch abi.ChainEpoch) FeeSegment {
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].Start > epoch })
+	return segs[i-1]
+}
+
+// constantSegment 返回从 start 开始不再变化的一段
+func constantSegment(start abi.ChainEpoch, v abi.TokenAmount) FeeSegment {
+	return FeeSegment{Start: start, Base: v, Num: big.Zero(), Slope: big.Zero(), Denom: 1}
+}
+
+// terminationPolicies 按生效的网络版本从小到大排列
+var terminationPolicies = []struct {
+	since  network.Version
+	policy TerminationFeePolicy
+}{
+	{network.Version0, legacyTerminationPolicy{}},
+	{network.Version25, fip0098TerminationPolicy{}},
+}
+
+// TerminationPolicyFor 返回 nv 下生效的罚金规则
+func TerminationPolicyFor(nv network.Version) TerminationFeePolicy {
+	i := sort.Search(len(terminationPolicies), func(i int) bool {
+		return terminationPolicies[i].since > nv
+	})
+	return terminationPolicies[i-1].policy
+}
+
+// TerminationPolicyAt 返回 ts 所在网络版本的罚金规则
+func TerminationPolicyAt(ctx context.Context, lapi ChainReader, ts *types.TipSet) (TerminationFeePolicy, error) {
+	nv, err := lapi.StateNetworkVersion(ctx, ts.Key())
+	if err != nil {
+		return nil, fmt.Errorf("network version at %d: %w", ts.Height(), err)
+	}
+	return TerminationPolicyFor(nv), nil
+}
+
+// fip0098TerminationPolicy https://github.com/filecoin-project/FIPs/blob/master/FIPS/fip-0098.md
+type fip0098TerminationPolicy struct{}
+
+func (fip0098TerminationPolicy) Fee(epoch abi.ChainEpoch, info *miner.SectorOnChainInfo, faultFee abi.TokenAmount) (abi.TokenAmount, string) {
+	return pledgePenaltyForTerminationTerm(info.InitialPledge, int64(epoch-info.Activation), faultFee)
+}
+
+func (fip0098TerminationPolicy) AgeStart(info *miner.SectorOnChainInfo) abi.ChainEpoch {
+	return info.Activation
+}
+
+// Segments 依次是 2% 质押的下限、按年龄线性增长的 8.5% 质押和封顶后的 8.5% 质押
+func (fip0098TerminationPolicy) Segments(info *miner.SectorOnChainInfo) []FeeSegment {
+	simple := big.Div(big.Mul(info.InitialPledge, big.NewInt(termFeePledgeMultipleNum)), big.NewInt(termFeePledgeMultipleDenom))
+	floor := big.Div(big.Mul(info.InitialPledge, big.NewInt(termFeeMinPledgeMultipleNum)), big.NewInt(termFeeMinPledgeMultipleDenom))
+	segs := []FeeSegment{constantSegment(math.MinInt64, floor)}
+	if simple.IsZero() {
+		return segs
+	}
+
+	// 年龄达到 ceil(floor*cap/simple) 后按年龄计算的罚金不低于 2% 质押
+	capEpochs := big.NewInt(TerminationLifetimeCap * builtin.EpochsInDay)
+	k := big.Div(big.Sub(big.Add(big.Mul(floor, capEpochs), simple), big.NewInt(1)), simple)
+	if k.LessThan(capEpochs) {
+		segs = append(segs, FeeSegment{
+			Start: info.Activation + abi.ChainEpoch(k.Int64()),
+			Base:  big.Zero(),
+			Num:   big.Mul(simple, k),
+			Slope: simple,
+			Denom: capEpochs.Int64(),
+		})
+	}
+	return append(segs, constantSegment(info.Activation+TerminationLifetimeCap*builtin.EpochsInDay, simple))
+}
+
+func (fip0098TerminationPolicy) FaultFeeFloor(faultFee abi.TokenAmount) abi.TokenAmount {
+	return big.Div(big.Mul(faultFee, big.NewInt(termFeeMaxFaultFeeMultipleNum)), big.NewInt(termFeeMaxFaultFeeMultipleDenom))
+}
+
+// legacyTerminationPolicy 是 nv25 之前的公式
+type legacyTerminationPolicy struct{}
+
+func (legacyTerminationPolicy) AgeStart(info *miner.SectorOnChainInfo) abi.ChainEpoch {
+	return info.PowerBaseEpoch
+}
+
+// https://github.com/filecoin-project/builtin-actors/blob/54236ae89880bf4aa89b0dba6d9060c3fd2aacee/actors/miner/src/monies.rs#L202
+// ctrl c ctrl v 的，所以没有遵循golang的命名规范
+func (legacyTerminationPolicy) Fee(epoch abi.ChainEpoch, info *miner.SectorOnChainInfo, _ abi.TokenAmount) (abi.TokenAmount, string) {
+	expected_reward := legacyExpectedReward(epoch, info)
+	expected_reward = big.Div(expected_reward, big.NewInt(2))
+
+	penalty := big.Add(*info.ExpectedStoragePledge, big.Div(expected_reward, big.NewInt(builtin.EpochsInDay)))
+
+	// 说明用户把offset设置了很大的负数，这个时候罚金就是ExpectedStoragePledge
+	// 这样处理后，t = tsk.Height()+offset，t在上次续期时间之后是准确的；t在扇区激活-上次续期时间之间是不太准确的；t在扇区激活之前是准确的。
+	// |----|--bad--|----|
+	if epoch < info.Activation {
+		penalty = *info.ExpectedStoragePledge
+	}
+	return penalty, TermLegacy
+}
+
+// legacyExpectedReward 返回 epoch 时计入罚金的日奖励乘以天数（以高度计）
+func legacyExpectedReward(epoch abi.ChainEpoch, info *miner.SectorOnChainInfo) abi.TokenAmount {
+	lifetime_cap := int64(TerminationLifetimeCap * builtin.EpochsInDay)
+	var capped_sector_age int64
+	if sector_age := int64(epoch) - int64(info.PowerBaseEpoch); lifetime_cap < sector_age {
+		capped_sector_age = lifetime_cap
+	} else {
+		capped_sector_age = sector_age
+	}
+	if capped_sector_age < 0 {
+		capped_sector_age = 0
+	}
+	expected_reward := big.Mul(*info.ExpectedDayReward, big.NewInt(capped_sector_age))
+
+	var relevant_replaced_age int64
+	if replaced_sector_age := int64(info.PowerBaseEpoch) - int64(info.Activation); replaced_sector_age < lifetime_cap-capped_sector_age {
+		relevant_replaced_age = replaced_sector_age
+	} else {
+		relevant_replaced_age = lifetime_cap - capped_sector_age
+	}
+	return big.Add(expected_reward, big.Mul(*info.ReplacedDayReward, big.NewInt(relevant_replaced_age)))
+}
+
+// Segments 在激活、上次续期、续期前的奖励用完和年龄封顶处分段，段内 legacyExpectedReward 是线性的
+func (legacyTerminationPolicy) Segments(info *miner.SectorOnChainInfo) []FeeSegment {
+	capEpochs := abi.ChainEpoch(TerminationLifetimeCap * builtin.EpochsInDay)
+	replaced := info.PowerBaseEpoch - info.Activation
+	breaks := []abi.ChainEpoch{info.Activation, info.PowerBaseEpoch, info.PowerBaseEpoch + capEpochs - replaced, info.PowerBaseEpoch + capEpochs}
+	sort.Slice(breaks, func(i, j int) bool { return breaks[i] < breaks[j] })
+
+	segs := []FeeSegment{constantSegment(math.MinInt64, *info.ExpectedStoragePledge)}
+	for _, start := range breaks {
+		// 激活之前只有 ExpectedStoragePledge
+		if start < info.Activation || start == segs[len(segs)-1].Start {
+			continue
+		}
+		num := legacyExpectedReward(start, info)
+		segs = append(segs, FeeSegment{
+			Start: start,
+			Base:  *info.ExpectedStoragePledge,
+			Num:   num,
+			Slope: big.Sub(legacyExpectedReward(start+1, info), num),
+			Denom: 2 * builtin.EpochsInDay,
+		})
+	}
+	return segs
+}
+
+// FaultFeeFloor nv25 之前没有 fault fee 的下限
+func (legacyTerminationPolicy) FaultFeeFloor(abi.TokenAmount) abi.TokenAmount {
+	return big.Zero()
+}
@@ -0,0 +1,57 @@
+package calc
+
+import (
+	"math"
+	b "math/big"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	s "github.com/filecoin-project/go-state-types/builtin/v16/util/smoothing"
+)
+
+// Projection 描述 offset 为正数时如何把奖励/算力的平滑估计外推到目标高度
+// 增长率为 nil 时按估计自身的 velocity 线性外推，否则按每天的比例复利（-0.001 即每天 -0.1%）
+type Projection struct {
+	Enabled      bool
+	RewardGrowth *float64
+	PowerGrowth  *float64
+	// 每天的高度数，为 0 时按主网的 2880
+	EpochsPerDay abi.ChainEpoch
+}
+
+// Apply 返回外推 delta 个高度后的 reward 与 power 估计
+func (p Projection) Apply(reward, power s.FilterEstimate, delta abi.ChainEpoch) (s.FilterEstimate, s.FilterEstimate) {
+	if !p.Enabled || delta <= 0 {
+		return reward, power
+	}
+	return p.project(reward, delta, p.RewardGrowth), p.project(power, delta, p.PowerGrowth)
+}
+
+// project 外推一个 Q.128 的 FilterEstimate，位置不会小于 0
+func (p Projection) project(fe s.FilterEstimate, delta abi.ChainEpoch, growth *float64) s.FilterEstimate {
+	if growth == nil {
+		position := big.Add(fe.PositionEstimate, big.Mul(fe.VelocityEstimate, big.NewInt(int64(delta))))
+		return s.FilterEstimate{
+			PositionEstimate: big.Max(position, big.Zero()),
+			VelocityEstimate: fe.VelocityEstimate,
+		}
+	}
+
+	// position * (1+g)^days, velocity = position * ((1+g)^(1/epochsPerDay) - 1)
+	epochsPerDay := float64(2880)
+	if p.EpochsPerDay > 0 {
+		epochsPerDay = float64(p.EpochsPerDay)
+	}
+	position := scaleInt(fe.PositionEstimate, math.Pow(1+*growth, float64(delta)/epochsPerDay))
+	return s.FilterEstimate{
+		PositionEstimate: position,
+		VelocityEstimate: scaleInt(position, math.Pow(1+*growth, 1/epochsPerDay)-1),
+	}
+}
+
+func scaleInt(v big.Int, f float64) big.Int {
+	r := new(b.Float).SetPrec(256).SetInt(v.Int)
+	r.Mul(r, new(b.Float).SetPrec(256).SetFloat64(f))
+	i, _ := r.Int(nil)
+	return big.NewFromGo(i)
+}
@@ -0,0 +1,221 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// SectorLocation 扇区所在的 deadline 和 partition
+type SectorLocation struct {
+	Deadline  uint64
+	Partition uint64
+}
+
+// MinerSectors 是矿工在某个 tipset 上的扇区，会被多个调用共用，不要修改
+type MinerSectors struct {
+	Info       api.MinerInfo
+	Deadline   *dline.Info
+	Partitions []*MinerPartition
+	Locations  map[uint64]SectorLocation
+	Sectors    []*miner.SectorOnChainInfo
+}
+
+// size 估算占用的内存
+func (ms *MinerSectors) size() int64 {
+	return int64(len(ms.Sectors))*400 + int64(len(ms.Locations))*64 + int64(len(ms.Partitions))*512
+}
+
+// LoadMinerSectors 读取矿工的扇区，allSectors 为 false 时只保留 live 扇区
+func LoadMinerSectors(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address, allSectors bool) (*MinerSectors, error) {
+	key := fmt.Sprintf("sectors/%s/%v", mid, allSectors)
+	return cachedLoad(ctx, tsk, key, (*MinerSectors).size, func(ctx context.Context) (*MinerSectors, error) {
+		return fetchMinerSectors(ctx, lapi, tsk, mid, allSectors)
+	})
+}
+
+func fetchMinerSectors(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address, allSectors bool) (*MinerSectors, error) {
+	minerInfo, err := lapi.StateMinerInfo(ctx, mid, tsk.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	cd, err := lapi.StateMinerProvingDeadline(ctx, mid, tsk.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	// 在本地遍历矿工状态，区块通过 ChainReadObj 读取并缓存
+	mas, err := LoadMinerState(ctx, lapi, tsk, mid)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := loadMinerPartitions(ctx, mas)
+	if err != nil {
+		return nil, err
+	}
+	locations := make(map[uint64]SectorLocation)
+	for _, p := range parts {
+		err := p.All.ForEach(func(sec uint64) error {
+			locations[sec] = p.SectorLocation
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var onChainInfo []*miner.SectorOnChainInfo
+	if allSectors {
+		onChainInfo, err = mas.LoadSectors(nil)
+	} else {
+		onChainInfo, err = loadLiveSectors(ctx, mas, parts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &MinerSectors{
+		Info:       minerInfo,
+		Deadline:   cd,
+		Partitions: parts,
+		Locations:  locations,
+		Sectors:    onChainInfo,
+	}, nil
+}
+
+// QuantizedExpiration 扇区实际过期的高度，按所在 deadline 向上取整
+func (ms *MinerSectors) QuantizedExpiration(info *miner.SectorOnChainInfo) abi.ChainEpoch {
+	return ms.Quantize(ms.Locations[uint64(info.SectorNumber)].Deadline, info.Expiration)
+}
+
+// Quantize 把高度按 deadline 向上取整
+func (ms *MinerSectors) Quantize(dl uint64, epoch abi.ChainEpoch) abi.ChainEpoch {
+	return m.QuantSpecForDeadline(m.NewDeadlineInfo(ms.Deadline.PeriodStart, dl, 0)).QuantizeUp(epoch)
+}
+
+// PenaltyOptions 是计算终结罚金的参数
+type PenaltyOptions struct {
+	// 包含已经过期的扇区
+	AllSectors bool
+	// 相对 ts 的高度偏移，罚金按 ts.Height()+Offset 终结计算
+	Offset abi.ChainEpoch
+	// Offset 为正数时平滑估计的外推方式
+	Projection Projection
+}
+
+// SectorPenalty 是一个扇区的终结罚金，金额单位为 attoFIL
+type SectorPenalty struct {
+	SectorNumber        abi.SectorNumber
+	Deadline            uint64
+	Partition           uint64
+	Activation          abi.ChainEpoch
+	PowerBaseEpoch      abi.ChainEpoch
+	Expiration          abi.ChainEpoch
+	QuantizedExpiration abi.ChainEpoch
+	InitialPledge       abi.TokenAmount
+	QAPower             abi.StoragePower
+	Age                 abi.ChainEpoch // 从终结策略的 AgeStart 算起
+	FaultFee            abi.TokenAmount
+	Penalty             abi.TokenAmount
+	// 起决定作用的项，见 Term* 常量
+	BindingTerm string
+	// FIP-100 日费，以及从 ts.Height()+Offset 到过期还要扣除的总费用
+	DailyFee     abi.TokenAmount
+	RemainingFee abi.TokenAmount
+}
+
+// SectorPenalties 逐个扇区计算矿工在 ts.Height()+opts.Offset 终结时的罚金，按扇区号排序
+func SectorPenalties(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address, opts PenaltyOptions) ([]*SectorPenalty, *MinerSectors, error) {
+	ms, err := LoadMinerSectors(ctx, lapi, ts, mid, opts.AllSectors)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rewardEstimate, networkQAPowerEstimate, err := GetSmoothing(ctx, lapi, ts)
+	if err != nil {
+		return nil, nil, err
+	}
+	rewardEstimate, networkQAPowerEstimate = opts.Projection.Apply(rewardEstimate, networkQAPowerEstimate, opts.Offset)
+	policy, err := TerminationPolicyAt(ctx, lapi, ts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	epoch := ts.Height() + opts.Offset
+	rows := make([]*SectorPenalty, 0, len(ms.Sectors))
+	for _, info := range ms.Sectors {
+		penalty, faultFee, term := SectorTerminationFee(policy, epoch, ms.Info.SectorSize, info, rewardEstimate, networkQAPowerEstimate)
+		loc := ms.Locations[uint64(info.SectorNumber)]
+		dailyFee := big.Zero()
+		if !info.DailyFee.Nil() {
+			dailyFee = info.DailyFee
+		}
+		payments := ms.FeePayments(loc.Deadline, ms.QuantizedExpiration(info), epoch)
+		rows = append(rows, &SectorPenalty{
+			SectorNumber:        info.SectorNumber,
+			Deadline:            loc.Deadline,
+			Partition:           loc.Partition,
+			Activation:          info.Activation,
+			PowerBaseEpoch:      info.PowerBaseEpoch,
+			Expiration:          info.Expiration,
+			QuantizedExpiration: ms.QuantizedExpiration(info),
+			InitialPledge:       info.InitialPledge,
+			QAPower:             m.QAPowerForSector(ms.Info.SectorSize, info),
+			Age:                 epoch - policy.AgeStart(info),
+			FaultFee:            faultFee,
+			Penalty:             penalty,
+			BindingTerm:         term,
+			DailyFee:            dailyFee,
+			RemainingFee:        big.Mul(dailyFee, big.NewInt(payments)),
+		})
+	}
+	return rows, ms, nil
+}
+
+// ExpirationDay 是同一天过期的扇区汇总
+type ExpirationDay struct {
+	Day     string
+	Sectors int
+	// 原值算力，字节
+	Power   abi.StoragePower
+	Pledge  abi.TokenAmount
+	Penalty abi.TokenAmount
+	// 这些扇区的日费（从这天起不再扣除），以及它们过期前还要扣除的总费用
+	DailyFee     abi.TokenAmount
+	RemainingFee abi.TokenAmount
+}
+
+// ExpirationsByDay 按 dayOf(实际过期高度) 把扇区分组汇总，dayOf 返回的字符串按字典序排序
+func ExpirationsByDay(rows []*SectorPenalty, sectorSize abi.SectorSize, dayOf func(abi.ChainEpoch) string) []*ExpirationDay {
+	byDay := make(map[string]*ExpirationDay)
+	for _, r := range rows {
+		day := dayOf(r.QuantizedExpiration)
+		d, ok := byDay[day]
+		if !ok {
+			d = &ExpirationDay{Day: day, Power: big.Zero(), Pledge: big.Zero(), Penalty: big.Zero(), DailyFee: big.Zero(), RemainingFee: big.Zero()}
+			byDay[day] = d
+		}
+		d.Sectors++
+		d.Power = big.Add(d.Power, big.NewInt(int64(sectorSize)))
+		d.Pledge = big.Add(d.Pledge, r.InitialPledge)
+		d.Penalty = big.Add(d.Penalty, r.Penalty)
+		d.DailyFee = big.Add(d.DailyFee, r.DailyFee)
+		d.RemainingFee = big.Add(d.RemainingFee, r.RemainingFee)
+	}
+	days := make([]*ExpirationDay, 0, len(byDay))
+	for _, d := range byDay {
+		days = append(days, d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	return days
+}
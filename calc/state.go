@@ -0,0 +1,144 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	lru "github.com/hashicorp/golang-lru/v2"
+	blocks "github.com/ipfs/go-block-format"
+	"golang.org/x/sync/errgroup"
+)
+
+// 并发读取 deadline 和扇区的协程数
+const stateWorkers = 16
+
+// 缓存的区块数，状态区块按内容寻址，不同 tipset 之间可以共用
+const blockCacheSize = 1 << 18
+
+var blockCache = func() *lru.Cache[blockstore.MhString, blocks.Block] {
+	c, err := lru.New[blockstore.MhString, blocks.Block](blockCacheSize)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}()
+
+// stateStore 通过 ChainReadObj 读取链状态，读到的区块会被缓存
+func stateStore(ctx context.Context, lapi ChainReader) adt.Store {
+	bs := blockstore.NewReadCachedBlockstore(blockstore.NewAPIBlockstore(lapi), blockCache)
+	return store.ActorStore(ctx, bs)
+}
+
+// MinerPartition 是一个 partition 中的全部扇区、live 扇区和 faulty 扇区
+type MinerPartition struct {
+	SectorLocation
+	All    bitfield.BitField
+	Live   bitfield.BitField
+	Faulty bitfield.BitField
+}
+
+// loadMinerPartitions 在本地遍历矿工状态中的 deadline 和 partition，代替 48 次 StateMinerPartitions
+func loadMinerPartitions(ctx context.Context, mas miner.State) ([]*MinerPartition, error) {
+	var (
+		mu    sync.Mutex
+		parts []*MinerPartition
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(stateWorkers)
+	err := mas.ForEachDeadline(func(dlIdx uint64, dl miner.Deadline) error {
+		g.Go(func() error {
+			return dl.ForEachPartition(func(pIdx uint64, part miner.Partition) error {
+				// 有 worker 出错或请求取消时不再继续读取
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				all, err := part.AllSectors()
+				if err != nil {
+					return err
+				}
+				live, err := part.LiveSectors()
+				if err != nil {
+					return err
+				}
+				faulty, err := part.FaultySectors()
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				parts = append(parts, &MinerPartition{
+					SectorLocation: SectorLocation{Deadline: dlIdx, Partition: pIdx},
+					All:            all,
+					Live:           live,
+					Faulty:         faulty,
+				})
+				mu.Unlock()
+				return nil
+			})
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].Deadline != parts[j].Deadline {
+			return parts[i].Deadline < parts[j].Deadline
+		}
+		return parts[i].Partition < parts[j].Partition
+	})
+	return parts, nil
+}
+
+// loadLiveSectors 按 partition 并发读取 live 扇区，结果按扇区号排序
+func loadLiveSectors(ctx context.Context, mas miner.State, parts []*MinerPartition) ([]*miner.SectorOnChainInfo, error) {
+	var (
+		mu      sync.Mutex
+		sectors []*miner.SectorOnChainInfo
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(stateWorkers)
+	for _, p := range parts {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if empty, err := p.Live.IsEmpty(); err != nil || empty {
+				return err
+			}
+			infos, err := mas.LoadSectors(&p.Live)
+			if err != nil {
+				return fmt.Errorf("load sectors of deadline %d partition %d: %w", p.Deadline, p.Partition, err)
+			}
+			mu.Lock()
+			sectors = append(sectors, infos...)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i].SectorNumber < sectors[j].SectorNumber })
+	return sectors, nil
+}
+
+// LoadMinerState 读取矿工在 tsk 上的合约状态，区块通过 ChainReadObj 读取并缓存
+func LoadMinerState(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address) (miner.State, error) {
+	act, err := lapi.StateGetActor(ctx, mid, tsk.Key())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load miner actor: %w", err)
+	}
+	return miner.Load(stateStore(ctx, lapi), act)
+}
@@ -0,0 +1,49 @@
+package calc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// VestedDay 是 (End-step, End] 之间释放的锁仓，单位 attoFIL
+type VestedDay struct {
+	End    abi.ChainEpoch
+	Vested abi.TokenAmount
+}
+
+// VestingSchedule 读取 ts 时矿工的锁仓，从 start 起每隔 step 计算一次释放，直到全部释放
+func VestingSchedule(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address, start, step abi.ChainEpoch) ([]VestedDay, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("invalid step %d", step)
+	}
+	mas, err := LoadMinerState(ctx, lapi, ts, mid)
+	if err != nil {
+		return nil, err
+	}
+	lockedFund, err := mas.LockedFunds()
+	if err != nil {
+		return nil, err
+	}
+
+	var days []VestedDay
+	oldVested := abi.NewTokenAmount(0)
+	for epoch := start; lockedFund.VestingFunds.GreaterThan(big.NewInt(0)); {
+		epoch += step
+		vested, err := mas.VestedFunds(epoch)
+		if err != nil {
+			return nil, err
+		}
+
+		dayVested := big.Sub(vested, oldVested)
+		oldVested = vested
+
+		lockedFund.VestingFunds = big.Sub(lockedFund.VestingFunds, dayVested)
+		days = append(days, VestedDay{End: epoch, Vested: dayVested})
+	}
+	return days, nil
+}
@@ -0,0 +1,6 @@
+package main
+
+import "github.com/beck-8/sectors_penalty/calc"
+
+// ChainReader 是本程序用到的 lotus FullNode 接口子集，lotus 节点、offlineNode 和 memChain 都实现了它
+type ChainReader = calc.ChainReader
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+)
+
+// 子命令共用的参数
+var (
+	formatFlag = &cli.StringFlag{Name: "format", Usage: "Output format: csv, tsv, json, ndjson, markdown, table or xlsx, defaults to the same as the HTTP route"}
+	heightFlag = &cli.Int64Flag{Name: "height", Usage: "Compute at the tipset of this height, defaults to the head"}
+	offsetFlag = &cli.Int64Flag{Name: "offset", Usage: "How many days to shift forward/backward (+20/-20)"}
+	ownerFlag  = &cli.StringSliceFlag{Name: "owner", Usage: "Also compute all miners with locked funds whose owner or worker is this address"}
+)
+
+var penaltyCmd = &cli.Command{
+	Name:      "penalty",
+	Usage:     "Sector expirations and termination penalties by expiration date",
+	ArgsUsage: "<miner>...",
+	Flags: []cli.Flag{
+		formatFlag,
+		heightFlag,
+		offsetFlag,
+		ownerFlag,
+		&cli.BoolFlag{Name: "all", Usage: "Include expired sectors"},
+		&cli.BoolFlag{Name: "history", Usage: "For a negative offset, read the chain state of that day (needs a node that still has that state)"},
+		&cli.BoolFlag{Name: "fees", Usage: "Add the FIP-100 daily fee calendar: fee stopping and fee liability by expiration date, projected fee outflow per day"},
+	},
+	Action: func(cctx *cli.Context) error {
+		return runCommand(cctx, true, formatCSV, func(lapi ChainReader, ts *types.TipSet, mids []address.Address, many bool) (*types.TipSet, *result, error) {
+			ts, offset, err := historyTipSet(cctx.Context, lapi, ts, abi.ChainEpoch(cctx.Int64("offset"))*netProfile.epochsPerDay(), cctx.Bool("history"))
+			if err != nil {
+				return nil, nil, err
+			}
+			if many {
+				res, err := computeMiners(cctx.Context, lapi, ts, mids, cctx.Bool("all"), offset, calc.Projection{}, cctx.Bool("fees"))
+				return ts, res, err
+			}
+			res, err := Compute(cctx.Context, lapi, ts, mids[0], cctx.Bool("all"), offset, calc.Projection{}, cctx.Bool("fees"))
+			return ts, res, err
+		})
+	},
+}
+
+var vestedCmd = &cli.Command{
+	Name:      "vested",
+	Usage:     "Vesting schedule of the miner's locked funds",
+	ArgsUsage: "<miner>...",
+	Flags:     []cli.Flag{formatFlag, heightFlag, offsetFlag, ownerFlag},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Int64("offset") > 0 {
+			return fmt.Errorf("offset can only be negative")
+		}
+		return runCommand(cctx, true, formatCSV, func(lapi ChainReader, ts *types.TipSet, mids []address.Address, many bool) (*types.TipSet, *result, error) {
+			ts, startEpoch, err := vestedStart(cctx.Context, lapi, ts, cctx.Int64("offset"))
+			if err != nil {
+				return nil, nil, err
+			}
+			if many {
+				res, err := getVestedMiners(cctx.Context, lapi, ts, startEpoch, mids)
+				return ts, res, err
+			}
+			res, err := getVested(cctx.Context, lapi, ts, startEpoch, mids[0])
+			return ts, res, err
+		})
+	},
+}
+
+var dailyFeeCmd = &cli.Command{
+	Name:  "dailyfee",
+	Usage: "Current network FIP-100 daily fee",
+	Flags: []cli.Flag{formatFlag, heightFlag},
+	Action: func(cctx *cli.Context) error {
+		return runCommand(cctx, false, formatTable, func(lapi ChainReader, ts *types.TipSet, _ []address.Address, _ bool) (*types.TipSet, *result, error) {
+			res, err := computeDailyFee(cctx.Context, lapi, ts)
+			return ts, res, err
+		})
+	},
+}
+
+var spDailyFeeCmd = &cli.Command{
+	Name:      "spdailyfee",
+	Usage:     "Daily fee of a miner",
+	ArgsUsage: "<miner>...",
+	Flags:     []cli.Flag{formatFlag, heightFlag, ownerFlag},
+	Action: func(cctx *cli.Context) error {
+		return runCommand(cctx, true, formatTable, func(lapi ChainReader, ts *types.TipSet, mids []address.Address, many bool) (*types.TipSet, *result, error) {
+			if many {
+				res, err := computeSpDailyFeeMiners(cctx.Context, lapi, ts, mids)
+				return ts, res, err
+			}
+			res, err := computeSpDailyFee(cctx.Context, lapi, ts, mids[0])
+			return ts, res, err
+		})
+	},
+}
+
+var faultFeeCmd = &cli.Command{
+	Name:  "faultfee",
+	Usage: "Fault fee of a 32G sector",
+	Flags: []cli.Flag{formatFlag, heightFlag},
+	Action: func(cctx *cli.Context) error {
+		return runCommand(cctx, false, formatTable, func(lapi ChainReader, ts *types.TipSet, _ []address.Address, _ bool) (*types.TipSet, *result, error) {
+			fee, err := computeFaultFee(cctx.Context, lapi, ts)
+			if err != nil {
+				return nil, nil, err
+			}
+			return ts, faultFeeResult(fee), nil
+		})
+	},
+}
+
+var alertsCmd = &cli.Command{
+	Name:      "alerts",
+	Usage:     "Evaluate the alert rules once and send the firing ones to their webhooks",
+	ArgsUsage: "<miner>...",
+	Flags: []cli.Flag{
+		formatFlag,
+		heightFlag,
+		ownerFlag,
+		&cli.StringFlag{Name: "rules", Required: true, Usage: "JSON file of alert rules"},
+		&cli.BoolFlag{Name: "dry-run", Usage: "Only print the firing alerts, send nothing"},
+	},
+	Action: func(cctx *cli.Context) error {
+		rules, err := loadAlertRules(cctx.String("rules"))
+		if err != nil {
+			return err
+		}
+		return runCommand(cctx, true, formatTable, func(lapi ChainReader, ts *types.TipSet, mids []address.Address, _ bool) (*types.TipSet, *result, error) {
+			events, err := computeAlerts(cctx.Context, lapi, ts, mids, rules)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !cctx.Bool("dry-run") {
+				for _, ev := range events {
+					if err := ev.send(cctx.Context); err != nil {
+						return nil, nil, fmt.Errorf("rule %s, miner %s: %w", ev.Rule, ev.Miner, err)
+					}
+				}
+			}
+			return ts, alertsResult(events), nil
+		})
+	},
+}
+
+// runCommand 解析矿工、高度和输出格式，调用 compute 后按格式输出，没有指定格式时使用 def
+// 多个矿工或指定了 --owner 时 many 为 true
+func runCommand(cctx *cli.Context, needMiner bool, def outputFormat, compute func(lapi ChainReader, ts *types.TipSet, mids []address.Address, many bool) (*types.TipSet, *result, error)) error {
+	var q *minerQuery
+	if needMiner {
+		var err error
+		q, err = parseMinerQuery(strings.Join(cctx.Args().Slice(), ","), strings.Join(cctx.StringSlice("owner"), ","), true)
+		if err != nil {
+			return err
+		}
+	}
+	f := def
+	// text 是以前的默认格式
+	if v := cctx.String("format"); v != "" && v != "text" {
+		var err error
+		if f, err = parseOutputFormat(v); err != nil {
+			return err
+		}
+	}
+
+	lapi := openChainCtx(cctx)
+	var height string
+	if cctx.IsSet("height") {
+		height = strconv.FormatInt(cctx.Int64("height"), 10)
+	}
+	ts, err := lookupTipSet(cctx.Context, lapi, "", height)
+	if err != nil {
+		return err
+	}
+
+	var mids []address.Address
+	var many bool
+	if q != nil {
+		if mids, err = q.resolve(cctx.Context, lapi, ts); err != nil {
+			return err
+		}
+		many = q.many()
+	}
+
+	ts, res, err := compute(lapi, ts, mids, many)
+	if err != nil {
+		return err
+	}
+	// 与 HTTP 接口相同格式的输出
+	data, err := res.render(f, ts)
+	if err != nil {
+		return err
+	}
+	if f == formatJSON {
+		data = append(data, '\n')
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/gin-gonic/gin"
+)
+
+// curveBucket 按过期日期分组的扇区
+type curveBucket struct {
+	Date    string `json:"date"`
+	Sectors int    `json:"sectors_sum"`
+	// 该组所有扇区的年龄都达到 TerminationLifetimeCap 的日期，过期前达不到则为空
+	CapDate string `json:"cap_date"`
+}
+
+type curvePoint struct {
+	Date    string   `json:"date"`
+	Penalty string   `json:"penalty"`
+	Buckets []string `json:"buckets"` // 与 penaltyCurve.Buckets 一一对应
+}
+
+type penaltyCurve struct {
+	Buckets []*curveBucket `json:"buckets"`
+	Days    []*curvePoint  `json:"days"`
+}
+
+func penaltyCurveHandler(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+		req, ok := parsePenaltyRequest(lapi, c, false)
+		if !ok {
+			return
+		}
+		// 每隔多少天计算一次
+		step, _ := strconv.ParseInt(c.DefaultQuery("step", "1"), 10, 64)
+		if step < 1 {
+			step = 1
+		}
+
+		curve, err := computePenaltyCurve(c.Request.Context(), lapi, req, abi.ChainEpoch(step)*netProfile.epochsPerDay())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		render(c, req.ts, f, &result{data: curve, records: curve.Days, table: curve.table()})
+	}
+}
+
+// table 的表头为日期、总罚金和每个过期日期的罚金，最后一行是每组达到上限的日期
+func (pc *penaltyCurve) table() *table {
+	t := &table{Header: []string{"date", "penalty"}}
+	caps := []string{"cap_date", ""}
+	for _, bk := range pc.Buckets {
+		t.Header = append(t.Header, bk.Date)
+		caps = append(caps, bk.CapDate)
+	}
+	for _, p := range pc.Days {
+		t.Rows = append(t.Rows, append([]string{p.Date, p.Penalty}, p.Buckets...))
+	}
+	t.Rows = append(t.Rows, caps)
+	return t
+}
+
+// computePenaltyCurve 从 req.offset 开始每隔 step 计算一次全部扇区的终结罚金，直到最后一个扇区过期
+// 每个扇区的罚金只在分段处改变，先把各段按天累加到所在的过期日期分组，再对每组逐天求和
+// 同一分母的段先把分子相加再取整，所以每天的罚金与逐个扇区计算相比最多少扇区数个 attoFIL
+func computePenaltyCurve(ctx context.Context, lapi ChainReader, req *penaltyRequest, step abi.ChainEpoch) (*penaltyCurve, error) {
+	tsk := req.ts
+	ms, err := calc.LoadMinerSectors(ctx, lapi, tsk, req.mid, false)
+	if err != nil {
+		return nil, err
+	}
+	rewardEstimate, networkQAPowerEstimate, err := calc.GetSmoothing(ctx, lapi, tsk)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := calc.TerminationPolicyAt(ctx, lapi, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	type curveSector struct {
+		info       *miner.SectorOnChainInfo
+		expiration abi.ChainEpoch
+		qaPower    string
+	}
+	// 先按过期日期排序分组
+	dates := make([]string, len(ms.Sectors))
+	bucketIdx := make(map[string]int)
+	for i, info := range ms.Sectors {
+		dates[i] = heightToTime(int64(ms.QuantizedExpiration(info)))
+		bucketIdx[dates[i]] = 0
+	}
+	buckets := make([]*curveBucket, 0, len(bucketIdx))
+	for date := range bucketIdx {
+		buckets = append(buckets, &curveBucket{Date: date})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Date < buckets[j].Date })
+	for i, bk := range buckets {
+		bucketIdx[bk.Date] = i
+	}
+
+	// 每组达到上限的高度和最晚的过期高度
+	capEpochs := make([]abi.ChainEpoch, len(buckets))
+	bucketExps := make([]abi.ChainEpoch, len(buckets))
+	bucketSectors := make([][]curveSector, len(buckets))
+	qaPowers := make(map[string]abi.StoragePower)
+	var last abi.ChainEpoch
+	for i, info := range ms.Sectors {
+		qe := ms.QuantizedExpiration(info)
+		idx := bucketIdx[dates[i]]
+		buckets[idx].Sectors++
+
+		if capAt := policy.AgeStart(info) + calc.TerminationLifetimeCap*builtin.EpochsInDay; capAt > capEpochs[idx] {
+			capEpochs[idx] = capAt
+		}
+		if qe > bucketExps[idx] {
+			bucketExps[idx] = qe
+		}
+		if qe > last {
+			last = qe
+		}
+		qaPower := m.QAPowerForSector(ms.Info.SectorSize, info)
+		qaPowers[qaPower.String()] = qaPower
+		bucketSectors[idx] = append(bucketSectors[idx], curveSector{info: info, expiration: qe, qaPower: qaPower.String()})
+	}
+	for i, bk := range buckets {
+		if capEpochs[i] < bucketExps[i] {
+			bk.CapDate = heightToTime(int64(capEpochs[i]))
+		}
+	}
+
+	var heights []abi.ChainEpoch
+	for offset := req.offset; tsk.Height()+offset < last; offset += step {
+		heights = append(heights, tsk.Height()+offset)
+	}
+	// dayIndex 返回高度不小于 epoch 的第一天
+	dayIndex := func(epoch abi.ChainEpoch) int {
+		return sort.Search(len(heights), func(j int) bool { return heights[j] >= epoch })
+	}
+
+	// 同一天内 fault fee 只与 QA 算力有关，maxFloors 是到这一天为止最大的下限
+	floors := make(map[string][]abi.TokenAmount, len(qaPowers))
+	maxFloors := make(map[string][]abi.TokenAmount, len(qaPowers))
+	for key := range qaPowers {
+		floors[key] = make([]abi.TokenAmount, len(heights))
+		maxFloors[key] = make([]abi.TokenAmount, len(heights))
+	}
+	for j, height := range heights {
+		reward, power := req.proj.Apply(rewardEstimate, networkQAPowerEstimate, height-tsk.Height())
+		for key, qaPower := range qaPowers {
+			floors[key][j] = policy.FaultFeeFloor(calc.FaultFeeForPower(qaPower, reward, power))
+			maxFloors[key][j] = floors[key][j]
+			if j > 0 {
+				maxFloors[key][j] = big.Max(maxFloors[key][j], maxFloors[key][j-1])
+			}
+		}
+	}
+
+	curve := &penaltyCurve{Buckets: buckets}
+	totals := make([]abi.TokenAmount, len(heights))
+	for j, height := range heights {
+		totals[j] = abi.NewTokenAmount(0)
+		curve.Days = append(curve.Days, &curvePoint{
+			Date:    heightToTime(int64(height)),
+			Buckets: make([]string, len(buckets)),
+		})
+	}
+	for idx := range buckets {
+		days := newCurveDeltas(len(heights))
+		for _, sec := range bucketSectors[idx] {
+			// 已经过期的扇区不能再终结
+			end := dayIndex(sec.expiration)
+			if end == 0 {
+				continue
+			}
+			segs := policy.Segments(sec.info)
+
+			// fault fee 的下限可能起作用时逐天计算
+			if !segmentsAbove(segs, heights[:end], maxFloors[sec.qaPower][end-1]) {
+				for j, height := range heights[:end] {
+					days.exact[j] = big.Add(days.exact[j], big.Max(calc.SegmentAt(segs, height).At(height), floors[sec.qaPower][j]))
+				}
+				continue
+			}
+			for k, seg := range segs {
+				from, to := 0, end
+				if k > 0 {
+					from = dayIndex(seg.Start)
+				}
+				if k+1 < len(segs) {
+					to = min(to, dayIndex(segs[k+1].Start))
+				}
+				if from < to {
+					days.add(seg, from, to)
+				}
+			}
+		}
+		for j, v := range days.sum(heights) {
+			totals[j] = big.Add(totals[j], v)
+			curve.Days[j].Buckets[idx] = toFIL(v)
+		}
+	}
+	for j, total := range totals {
+		curve.Days[j].Penalty = toFIL(total)
+	}
+	return curve, nil
+}
+
+// segmentsAbove 判断 heights 这些天里分段的罚金是否都不低于 floor
+// 段内的罚金随高度单调，只需要比较每段的第一天和最后一天
+func segmentsAbove(segs []calc.FeeSegment, heights []abi.ChainEpoch, floor abi.TokenAmount) bool {
+	if floor.IsZero() {
+		return true
+	}
+	for k, seg := range segs {
+		from := 0
+		if k > 0 {
+			from = sort.Search(len(heights), func(j int) bool { return heights[j] >= seg.Start })
+		}
+		to := len(heights)
+		if k+1 < len(segs) {
+			to = sort.Search(len(heights), func(j int) bool { return heights[j] >= segs[k+1].Start })
+		}
+		if from >= to {
+			continue
+		}
+		if seg.At(heights[from]).LessThan(floor) || seg.At(heights[to-1]).LessThan(floor) {
+			return false
+		}
+	}
+	return true
+}
+
+// curveDeltas 按天的差分累加一组扇区的分段罚金
+// 第 j 天的罚金 = base[j] + sum(floor((num[j] + slope[j]*height) / denom)) + exact[j]，base、num、slope 是前缀和
+type curveDeltas struct {
+	base  []abi.TokenAmount
+	num   map[int64][]big.Int
+	slope map[int64][]big.Int
+	exact []abi.TokenAmount
+}
+
+func newCurveDeltas(days int) *curveDeltas {
+	return &curveDeltas{
+		base:  zeroAmounts(days + 1),
+		num:   make(map[int64][]big.Int),
+		slope: make(map[int64][]big.Int),
+		exact: zeroAmounts(days),
+	}
+}
+
+func zeroAmounts(n int) []abi.TokenAmount {
+	v := make([]abi.TokenAmount, n)
+	for i := range v {
+		v[i] = big.Zero()
+	}
+	return v
+}
+
+// add 在 [from, to) 这些天加上 seg
+func (cd *curveDeltas) add(seg calc.FeeSegment, from, to int) {
+	addRange(cd.base, seg.Base, from, to)
+	if seg.Num.IsZero() && seg.Slope.IsZero() {
+		return
+	}
+	if _, ok := cd.num[seg.Denom]; !ok {
+		cd.num[seg.Denom] = zeroAmounts(len(cd.base))
+		cd.slope[seg.Denom] = zeroAmounts(len(cd.base))
+	}
+	// Num + Slope*(height-Start) = (Num - Slope*Start) + Slope*height
+	addRange(cd.num[seg.Denom], big.Sub(seg.Num, big.Mul(seg.Slope, big.NewInt(int64(seg.Start)))), from, to)
+	addRange(cd.slope[seg.Denom], seg.Slope, from, to)
+}
+
+func addRange(deltas []big.Int, v big.Int, from, to int) {
+	if v.IsZero() {
+		return
+	}
+	deltas[from] = big.Add(deltas[from], v)
+	deltas[to] = big.Sub(deltas[to], v)
+}
+
+// sum 返回每天的罚金
+func (cd *curveDeltas) sum(heights []abi.ChainEpoch) []abi.TokenAmount {
+	out := make([]abi.TokenAmount, len(heights))
+	base := big.Zero()
+	num := make(map[int64]big.Int, len(cd.num))
+	slope := make(map[int64]big.Int, len(cd.slope))
+	for denom := range cd.num {
+		num[denom], slope[denom] = big.Zero(), big.Zero()
+	}
+	for j, height := range heights {
+		base = big.Add(base, cd.base[j])
+		v := big.Add(base, cd.exact[j])
+		for denom := range num {
+			num[denom] = big.Add(num[denom], cd.num[denom][j])
+			slope[denom] = big.Add(slope[denom], cd.slope[denom][j])
+			n := big.Add(num[denom], big.Mul(slope[denom], big.NewInt(int64(height))))
+			v = big.Add(v, big.Div(n, big.NewInt(denom)))
+		}
+		out[j] = v
+	}
+	return out
+}
@@ -1,241 +1,163 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"math/big"
 	"net/http"
 	"strconv"
 
+	"github.com/beck-8/sectors_penalty/calc"
 	"github.com/filecoin-project/go-address"
-	"github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/gin-gonic/gin"
-	"github.com/olekukonko/tablewriter"
 )
 
-type dailyFee struct {
-	Qap32G   float64 `json:"qap_32g"`
-	Qap1T    float64 `json:"qap_1t"`
-	Qap100T  float64 `json:"qap_100t"`
-	Qap1024T float64 `json:"qap_1024t"`
-}
-
-type spFee struct {
-	DailyFee float64 `json:"daily_fee"`
-	TotalFee float64 `json:"total_fee"`
-}
-
-var (
-	// 5.56e-15 / 32GiB = 5.56e-15 / (32 * 2^30) = 5.56e-15 / 34,359,738,368 ≈ 1.61817e-25
-	// k = 5.56e-15
+func getDailyFee(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatTable)
+		if !ok {
+			return
+		}
 
-	DAILY_FEE_CIRCULATING_SUPPLY_QAP_MULTIPLIER_NUM   = big.NewInt(161817)
-	DAILY_FEE_CIRCULATING_SUPPLY_QAP_MULTIPLIER_DENOM = new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil) // 10^30
-)
+		ts, ok := tipSetOrAbort(lapi, c)
+		if !ok {
+			return
+		}
 
-func getDailyFee(c *gin.Context) {
-	jsonOut, _ := strconv.ParseBool(c.DefaultQuery("json", "0"))
+		res, err := computeDailyFee(c.Request.Context(), lapi, ts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
 
-	data, err := computeDailyFee(jsonOut)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Code: http.StatusInternalServerError,
-			Msg:  err.Error(),
-		})
-		return
-	}
+		render(c, ts, f, res)
 
-	if jsonOut {
-		c.JSON(http.StatusOK, APIResponse{
-			Code: http.StatusOK,
-			Msg:  "OK",
-			Data: data,
-		})
-	} else {
-		c.String(200, data.(string))
 	}
+}
 
+// qapFee 是 /dailyfee 中一种 QA 算力的日费，以及按 210 天和 540 天扣费的总费用
+type qapFee struct {
+	Size     string    `json:"size"`
+	DailyFee filAmount `json:"daily_fee"`
+	Fee210   filAmount `json:"fee_210"`
+	Fee540   filAmount `json:"fee_540"`
 }
 
 // FIP-100
-func computeDailyFee(jsonOut bool) (interface{}, error) {
-
-	circulatingSupply, err := lapi.StateVMCirculatingSupplyInternal(ctx, types.EmptyTSK)
+func computeDailyFee(ctx context.Context, lapi ChainReader, head *types.TipSet) (*result, error) {
+	d, err := calc.NetworkDailyFee(ctx, lapi, head)
 	if err != nil {
 		return nil, err
 	}
 
-	d := dailyFee{
-		Qap32G:   CalculateQAPFee(circulatingSupply, big.NewInt(32<<30)),
-		Qap1T:    CalculateQAPFee(circulatingSupply, big.NewInt(1<<40)),
-		Qap100T:  CalculateQAPFee(circulatingSupply, big.NewInt(100<<40)),
-		Qap1024T: CalculateQAPFee(circulatingSupply, big.NewInt(1024<<40)),
-	}
-
-	if jsonOut {
-		return d, nil
+	out := struct {
+		FilCirculating filAmount `json:"fil_circulating"`
+		Sizes          []qapFee  `json:"sizes"`
+	}{FilCirculating: newFILAmount(d.CirculatingSupply.FilCirculating)}
+	t := &table{
+		Notes: append(tipSetNotes(head),
+			fmt.Sprintf("FilCirculating: %s FIL", out.FilCirculating.FIL)),
+		Header: []string{"Size(QAP)", "Daily Fee(attoFIL)", "Daily Fee(FIL)", "210 Fee(attoFIL)", "210 Fee(FIL)", "540 Fee(attoFIL)", "540 Fee(FIL)"},
+	}
+	for _, size := range []struct {
+		name string
+		fee  abi.TokenAmount
+	}{{"32G", d.Qap32G}, {"1T", d.Qap1T}, {"100T", d.Qap100T}, {"1024T", d.Qap1024T}} {
+		q := qapFee{
+			Size:     size.name,
+			DailyFee: newFILAmount(size.fee),
+			Fee210:   newFILAmount(big.Mul(size.fee, big.NewInt(210))),
+			Fee540:   newFILAmount(big.Mul(size.fee, big.NewInt(540))),
+		}
+		out.Sizes = append(out.Sizes, q)
+		t.Rows = append(t.Rows, []string{q.Size, q.DailyFee.Atto.String(), q.DailyFee.FIL, q.Fee210.Atto.String(), q.Fee210.FIL, q.Fee540.Atto.String(), q.Fee540.FIL})
 	}
+	return &result{data: out, records: out.Sizes, table: t}, nil
+}
 
-	head, err := lapi.ChainHead(ctx)
-	if err != nil {
-		return nil, err
+// tipSetNotes 是表格前的链高度、时间戳和 tipset
+func tipSetNotes(ts *types.TipSet) []string {
+	return []string{
+		fmt.Sprintf("Chain Height: %d", ts.Height()),
+		fmt.Sprintf("Chain Timestamp: %d", ts.MinTimestamp()),
+		fmt.Sprintf("Tipset: %s", ts.Key()),
 	}
-	// Create buffer and table writer
-	buf := new(bytes.Buffer)
-	buf.WriteString(fmt.Sprintf("Chain Height: %d\n", head.Height()))
-	buf.WriteString(fmt.Sprintf("Chain Timestamp: %d\n", head.MinTimestamp()))
-	buf.WriteString(fmt.Sprintf("FilCirculating: %s FIL\n", big.NewInt(0).Div(circulatingSupply.FilCirculating.Int, big.NewInt(1e18))))
-
-	table := tablewriter.NewWriter(buf)
-	// Set table title
-	table.SetCaption(false, "Daily Fee Details")
-	// Set table header
-	table.SetHeader([]string{"Size(QAP)", "Daily Fee(FIL)", "210 Fee(FIL)", "540 Fee(FIL)"})
-
-	// Add rows
-	table.Append([]string{"32G", fmt.Sprintf("%.12f", d.Qap32G), fmt.Sprintf("%.12f", d.Qap32G*210), fmt.Sprintf("%.12f", d.Qap32G*540)})
-	table.Append([]string{"1T", fmt.Sprintf("%.12f", d.Qap1T), fmt.Sprintf("%.12f", d.Qap1T*210), fmt.Sprintf("%.12f", d.Qap1T*540)})
-	table.Append([]string{"100T", fmt.Sprintf("%.12f", d.Qap100T), fmt.Sprintf("%.12f", d.Qap100T*210), fmt.Sprintf("%.12f", d.Qap100T*540)})
-	table.Append([]string{"1024T", fmt.Sprintf("%.12f", d.Qap1024T), fmt.Sprintf("%.12f", d.Qap1024T*210), fmt.Sprintf("%.12f", d.Qap1024T*540)})
-
-	// Configure table style
-	table.SetAlignment(tablewriter.ALIGN_LEFT)
-	table.SetBorder(true)
-
-	// Render table
-	table.Render()
-	return buf.String(), nil
 }
 
-// calculateQAPFee calculates the daily fee for a given QAP size in bytes
-func CalculateQAPFee(circulatingSupply api.CirculatingSupply, qapBytes *big.Int) float64 {
-	// DAILY_FEE_CIRCULATING_SUPPLY_QAP_MULTIPLIER_NUM * circulatingSupply.FilCirculating.Int * 32 * 2^30 / DAILY_FEE_CIRCULATING_SUPPLY_QAP_MULTIPLIER_DENOM
-	qap := new(big.Rat).SetInt(DAILY_FEE_CIRCULATING_SUPPLY_QAP_MULTIPLIER_NUM)
-	qap.Mul(qap, new(big.Rat).SetInt(circulatingSupply.FilCirculating.Int))
-	qap.Mul(qap, new(big.Rat).SetInt(qapBytes))
-	qap.Quo(qap, new(big.Rat).SetInt(DAILY_FEE_CIRCULATING_SUPPLY_QAP_MULTIPLIER_DENOM))
-	qap.Quo(qap, new(big.Rat).SetInt(big.NewInt(1e18)))
-
-	qapFloat, _ := qap.Float64()
-	return qapFloat
-}
+func getSpDailyFee(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := minerQueryOrAbort(c, true)
+		if !ok {
+			return
+		}
 
-func getSpDailyFee(c *gin.Context) {
-	miner := c.Query("miner")
-	if miner == "" {
-		c.JSON(http.StatusBadRequest, APIResponse{
-			Code: http.StatusBadRequest,
-			Msg:  "please specify a miner",
-		})
-		return
-	}
-	mid, err := address.NewFromString(miner)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, APIResponse{
-			Code: http.StatusBadRequest,
-			Msg:  err.Error(),
-		})
-		return
-	}
+		f, ok := formatOrAbort(c, formatTable)
+		if !ok {
+			return
+		}
+
+		ts, ok := tipSetOrAbort(lapi, c)
+		if !ok {
+			return
+		}
+		mids, ok := resolveOrAbort(lapi, c, q, ts)
+		if !ok {
+			return
+		}
 
-	jsonOut, _ := strconv.ParseBool(c.DefaultQuery("json", "0"))
+		var res *result
+		var err error
+		if q.many() {
+			res, err = computeSpDailyFeeMiners(c.Request.Context(), lapi, ts, mids)
+		} else {
+			res, err = computeSpDailyFee(c.Request.Context(), lapi, ts, mids[0])
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
 
-	data, err := computeSpDailyFee(mid, jsonOut)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Code: http.StatusInternalServerError,
-			Msg:  err.Error(),
-		})
-		return
-	}
+		render(c, ts, f, res)
 
-	if jsonOut {
-		c.JSON(http.StatusOK, APIResponse{
-			Code: http.StatusOK,
-			Msg:  "OK",
-			Data: data,
-		})
-	} else {
-		c.String(200, data.(string))
 	}
-
 }
 
-func computeSpDailyFee(mid address.Address, jsonOut bool) (interface{}, error) {
-	d := spFee{}
-
-	tsk, err := lapi.ChainHead(ctx)
-	if err != nil {
-		return "", err
-	}
+// minerFee 是 /spdailyfee 中的一行
+type minerFee struct {
+	Miner    string    `json:"miner"`
+	Sectors  int       `json:"sectors"`
+	DailyFee filAmount `json:"daily_fee"`
+	TotalFee filAmount `json:"total_fee"`
+}
 
-	deadlines, err := lapi.StateMinerDeadlines(ctx, mid, types.EmptyTSK)
-	if err != nil {
-		return "", err
-	}
-	for _, deadline := range deadlines {
-		if deadline.DailyFee.NilOrZero() {
-			continue
-		}
-		fee, _ := new(big.Rat).Quo(new(big.Rat).SetInt(deadline.DailyFee.Int), new(big.Rat).SetInt(big.NewInt(1e18))).Float64()
-		d.DailyFee += fee
-	}
+func newMinerFee(miner string, d *calc.MinerFee) minerFee {
+	return minerFee{Miner: miner, Sectors: d.Sectors, DailyFee: newFILAmount(d.DailyFee), TotalFee: newFILAmount(d.TotalFee)}
+}
 
-	liveSectors := make(map[uint64]bool)
-	for i := 0; i < 48; i++ {
-		partitions, err := lapi.StateMinerPartitions(ctx, mid, uint64(i), types.EmptyTSK)
-		if err != nil {
-			return "", err
-		}
-		for _, part := range partitions {
-			liveCount, err := part.LiveSectors.Count()
-			if err != nil {
-				return "", err
-			}
-			liveSector, err := part.LiveSectors.AllMap(liveCount)
-			if err != nil {
-				return "", err
-			}
-			for k, v := range liveSector {
-				liveSectors[k] = v
-			}
-		}
-	}
-	var onChainInfo []*miner.SectorOnChainInfo
-	tmp, err := lapi.StateMinerSectors(ctx, mid, nil, types.EmptyTSK)
+func computeSpDailyFee(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address) (*result, error) {
+	d, err := calc.MinerDailyFee(ctx, lapi, tsk, mid)
 	if err != nil {
-		return "", err
-	}
-	for _, v := range tmp {
-		if liveSectors[uint64(v.SectorNumber)] {
-			onChainInfo = append(onChainInfo, v)
-		}
+		return nil, err
 	}
+	fee := newMinerFee(mid.String(), d)
+	return &result{data: fee, table: minerFeeTable(tsk, []minerFee{fee})}, nil
+}
 
-	for _, info := range onChainInfo {
-		if info.DailyFee.NilOrZero() {
-			continue
-		}
-		// 简单计算，实际会有一天内的误差
-		// Simple calculation, there will actually be an error of one day
-		days := (float64(info.Expiration) - float64(tsk.Height())) / 2880
-		fee, _ := new(big.Rat).SetInt64(0).Quo(new(big.Rat).SetInt(info.DailyFee.Int), new(big.Rat).SetInt(big.NewInt(1e18))).Float64()
-		d.TotalFee += days * fee
+func minerFeeTable(tsk *types.TipSet, fees []minerFee) *table {
+	t := &table{
+		Notes:  append(tipSetNotes(tsk), "Ps: Daily Fee * day != Total Fee, because the expiration time of the sector is different; Total Fee counts the deadline fee payments left before each sector expires, see /penalty?fees=1 for the calendar"),
+		Header: []string{"miner", "sectors", "daily_fee(attoFIL)", "daily_fee(FIL)", "total_fee(attoFIL)", "total_fee(FIL)"},
 	}
-	if jsonOut {
-		return d, nil
+	for _, m := range fees {
+		t.Rows = append(t.Rows, []string{m.Miner, strconv.Itoa(m.Sectors), m.DailyFee.Atto.String(), m.DailyFee.FIL, m.TotalFee.Atto.String(), m.TotalFee.FIL})
 	}
-	buf := new(bytes.Buffer)
-	buf.WriteString(fmt.Sprintf("Chain Height: %d\n", tsk.Height()))
-	buf.WriteString(fmt.Sprintf("Chain Timestamp: %d\n", tsk.MinTimestamp()))
-	buf.WriteString(fmt.Sprintf("Miner: %s\n", mid.String()))
-	buf.WriteString(fmt.Sprintf("Sectors: %d\n", len(onChainInfo)))
-	buf.WriteString(fmt.Sprintf("Daily Fee: %.12f FIL\n", d.DailyFee))
-	buf.WriteString(fmt.Sprintf("Total Fee: %.12f FIL\n", d.TotalFee))
-	buf.WriteString("Ps: Daily Fee * day != Total Fee, because the expiration time of the sector is different")
-
-	return buf.String(), nil
-
+	return t
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/gin-gonic/gin"
+)
+
+type extendSector struct {
+	SectorNumber  abi.SectorNumber `json:"sector_number"`
+	Deadline      uint64           `json:"deadline"`
+	Partition     uint64           `json:"partition"`
+	Expiration    abi.ChainEpoch   `json:"expiration"`
+	NewExpiration abi.ChainEpoch   `json:"new_expiration"`
+	Date          string           `json:"date"`
+	NewDate       string           `json:"new_date"`
+	DailyFee      filAmount        `json:"daily_fee"`
+	NewDailyFee   filAmount        `json:"new_daily_fee"`
+	// 不能延期的原因
+	Reason string `json:"reason,omitempty"`
+}
+
+type extendPlan struct {
+	NewExpiration abi.ChainEpoch  `json:"new_expiration"`
+	Sectors       []*extendSector `json:"sectors"`
+	Rejected      []*extendSector `json:"rejected"`
+	// 延期不会重新计算初始质押，QA 算力也不变，所以质押变化为 0
+	PledgeDelta filAmount `json:"pledge_delta"`
+	// FIP-100，新增的每日费用和到新过期日期为止多付的总费用
+	AddedDailyFee filAmount       `json:"added_daily_fee"`
+	AddedTotalFee filAmount       `json:"added_total_fee"`
+	Batches       []*messageBatch `json:"batches"`
+}
+
+// sectorsExtend 为选中的扇区规划延期并生成 ExtendSectorExpiration2 消息
+func sectorsExtend(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+		req, ok := parsePenaltyRequest(lapi, c, false)
+		if !ok {
+			return
+		}
+		// 已经过期或终结的扇区不能再延期
+		req.allSectors = false
+		sel, err := parseSelection(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		t, err := time.ParseInLocation(dateFormat, c.Query("expiration"), time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  "please specify the new expiration date",
+			})
+			return
+		}
+		newExpiration := netProfile.heightAt(t)
+		// 默认由 worker 发送，也可以用 sender= 指定 owner 或控制地址
+		from, err := parseSender(c, address.Undef)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  err.Error(),
+			})
+			return
+		}
+
+		plan, err := planExtension(c, lapi, req, sel, from, newExpiration)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		sectors, batches := plan.tables()
+		render(c, req.ts, f, &result{data: plan, records: append(plan.Sectors, plan.Rejected...), table: sectors, more: []*table{batches}})
+	}
+}
+
+// tables 返回扇区表和消息表
+func (plan *extendPlan) tables() (*table, *table) {
+	sectors := &table{Header: []string{"sector", "deadline", "partition", "expiration", "new_expiration", "date", "new_date", "daily_fee(attoFIL)", "daily_fee(FIL)", "new_daily_fee(attoFIL)", "new_daily_fee(FIL)", "reason"}}
+	for _, r := range append(plan.Sectors, plan.Rejected...) {
+		sectors.Rows = append(sectors.Rows, []string{fmt.Sprint(r.SectorNumber), fmt.Sprint(r.Deadline), fmt.Sprint(r.Partition), fmt.Sprint(r.Expiration), fmt.Sprint(r.NewExpiration), r.Date, r.NewDate, r.DailyFee.Atto.String(), r.DailyFee.FIL, r.NewDailyFee.Atto.String(), r.NewDailyFee.FIL, r.Reason})
+	}
+	// 汇总数据，新增的日费和总费用
+	sectors.Rows = append(sectors.Rows, []string{strconv.Itoa(len(plan.Sectors)), "", "", "", "", "", "", plan.AddedDailyFee.Atto.String(), plan.AddedDailyFee.FIL, plan.AddedTotalFee.Atto.String(), plan.AddedTotalFee.FIL, ""})
+
+	batches := &table{Header: []string{"batch", "partitions", "sectors", "from", "to", "method", "params_hex"}}
+	for i, mb := range plan.Batches {
+		batches.Rows = append(batches.Rows, []string{strconv.Itoa(i), strconv.Itoa(mb.Partitions), strconv.Itoa(mb.Sectors), mb.Message.From.String(), mb.Message.To.String(), fmt.Sprint(mb.Message.Method), mb.ParamsHex})
+	}
+	return sectors, batches
+}
+
+// planExtension 校验每个选中扇区能否延期到 newExpiration，并计算 FIP-100 费用变化，from 为空时由 worker 发送
+func planExtension(c *gin.Context, lapi ChainReader, req *penaltyRequest, sel *sectorSelection, from address.Address, newExpiration abi.ChainEpoch) (*extendPlan, error) {
+	ctx := c.Request.Context()
+	rows, ms, err := computeSectorPenalties(ctx, lapi, req)
+	if err != nil {
+		return nil, err
+	}
+	if from == address.Undef {
+		from = ms.Info.Worker
+	}
+	nv, err := lapi.StateNetworkVersion(ctx, req.ts.Key())
+	if err != nil {
+		return nil, err
+	}
+	circulatingSupply, err := lapi.StateVMCirculatingSupplyInternal(ctx, req.ts.Key())
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[abi.SectorNumber]*miner.SectorOnChainInfo, len(ms.Sectors))
+	for _, info := range ms.Sectors {
+		infos[info.SectorNumber] = info
+	}
+
+	height := req.ts.Height()
+	plan := &extendPlan{NewExpiration: newExpiration, PledgeDelta: newFILAmount(big.Zero())}
+	addedDaily, addedTotal := big.Zero(), big.Zero()
+	var selected []*sectorPenalty
+	for _, r := range rows {
+		if !sel.match(r) {
+			continue
+		}
+		info := infos[r.SectorNumber]
+		es := &extendSector{
+			SectorNumber:  r.SectorNumber,
+			Deadline:      r.Deadline,
+			Partition:     r.Partition,
+			Expiration:    r.QuantizedExpiration,
+			NewExpiration: ms.Quantize(r.Deadline, newExpiration),
+			Date:          r.Date,
+		}
+		dailyFee := big.Zero()
+		if !info.DailyFee.Nil() {
+			dailyFee = info.DailyFee
+		}
+		// 不能延期的扇区日费不变
+		es.DailyFee, es.NewDailyFee = newFILAmount(dailyFee), newFILAmount(dailyFee)
+		es.NewDate = heightToTime(int64(es.NewExpiration))
+		if es.Reason = extensionRejection(ms, info, r.Deadline, height, newExpiration); es.Reason != "" {
+			plan.Rejected = append(plan.Rejected, es)
+			continue
+		}
+
+		// FIP-100: 没有每日费用的旧扇区在延期时按当前流通量开始收费，nv25 之前延期不收费
+		newDailyFee := dailyFee
+		if dailyFee.IsZero() && nv >= network.Version25 {
+			newDailyFee = calc.CalculateQAPFee(circulatingSupply, r.QAPower.Int)
+		}
+		es.NewDailyFee = newFILAmount(newDailyFee)
+		// 按剩余的扣费次数计算，与 /spdailyfee 的总费用相同
+		addedDaily = big.Add(addedDaily, big.Sub(newDailyFee, dailyFee))
+		addedTotal = big.Add(addedTotal, big.Sub(
+			big.Mul(newDailyFee, big.NewInt(ms.FeePayments(r.Deadline, es.NewExpiration, height))),
+			big.Mul(dailyFee, big.NewInt(ms.FeePayments(r.Deadline, es.Expiration, height)))))
+
+		plan.Sectors = append(plan.Sectors, es)
+		selected = append(selected, r)
+	}
+
+	plan.AddedDailyFee, plan.AddedTotalFee = newFILAmount(addedDaily), newFILAmount(addedTotal)
+
+	batches := batchByPartition(selected,
+		parseBatchLimit(c, "batch_partitions", m.DeclarationsMax),
+		parseBatchLimit(c, "batch_sectors", m.AddressedSectorsMax))
+	for _, batch := range batches {
+		mb, err := newExtendBatch(req.mid, from, batch, newExpiration)
+		if err != nil {
+			return nil, err
+		}
+		plan.Batches = append(plan.Batches, mb)
+	}
+	return plan, nil
+}
+
+// extensionRejection 与 builtin-actors 的校验一致，返回不能延期的原因，可以延期时为空
+func extensionRejection(ms *calc.MinerSectors, info *miner.SectorOnChainInfo, dl uint64, height, newExpiration abi.ChainEpoch) string {
+	if !deadlineIsMutable(ms.Deadline.PeriodStart, dl, height) {
+		return "deadline is immutable"
+	}
+	// 有 verified claim 的扇区需要在 SectorsWithClaims 中声明每个 claim，这里不处理
+	if !info.VerifiedDealWeight.IsZero() {
+		return "sector has verified claims"
+	}
+	if newExpiration <= info.Expiration {
+		return "new expiration is not after the current expiration"
+	}
+	if newExpiration > height+m.MaxSectorExpirationExtension {
+		return fmt.Sprintf("exceeds max extension of %d days", m.MaxSectorExpirationExtension/builtin.EpochsInDay)
+	}
+	maxLifetime, err := builtin.SealProofSectorMaximumLifetime(info.SealProof)
+	if err != nil {
+		return err.Error()
+	}
+	if newExpiration-info.Activation > maxLifetime {
+		return fmt.Sprintf("exceeds max lifetime of %d days", maxLifetime/builtin.EpochsInDay)
+	}
+	return ""
+}
+
+// newExtendBatch 把一批 partition 编码成 ExtendSectorExpiration2Params
+func newExtendBatch(mid, from address.Address, batch []*partitionSectors, newExpiration abi.ChainEpoch) (*messageBatch, error) {
+	params := &m.ExtendSectorExpiration2Params{}
+	for _, p := range batch {
+		params.Extensions = append(params.Extensions, m.ExpirationExtension2{
+			Deadline:      p.Deadline,
+			Partition:     p.Partition,
+			Sectors:       p.bitfield(),
+			NewExpiration: newExpiration,
+		})
+	}
+	return newMessageBatch(mid, from, builtin.MethodsMiner.ExtendSectorExpiration2, params, batch)
+}
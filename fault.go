@@ -1,42 +1,55 @@
 package main
 
 import (
+	"context"
 	"net/http"
-	"strconv"
 
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
-	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/gin-gonic/gin"
 )
 
-func faultFee(c *gin.Context) {
-	jsonOut, _ := strconv.ParseBool(c.DefaultQuery("json", "0"))
+func faultFee(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 没有用 format=、json=1 或 Accept 指定格式时为空
+		f, ok := formatOrAbort(c, "")
+		if !ok {
+			return
+		}
+
+		tsk, ok := tipSetOrAbort(lapi, c)
+		if !ok {
+			return
+		}
+		fee, err := computeFaultFee(c.Request.Context(), lapi, tsk)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  "GetSmoothing err",
+			})
+			return
+		}
+		if f == "" {
+			// 与以前一样只返回 attoFIL 数值
+			tipSetHeaders(c, tsk)
+			c.String(http.StatusOK, fee.String())
+			return
+		}
+		render(c, tsk, f, faultFeeResult(fee))
 
-	tsk, err := lapi.ChainHead(ctx)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Code: http.StatusInternalServerError,
-			Msg:  "ChainHead err",
-		})
-		return
-	}
-	rewardEstimate, networkQAPowerEstimate, err := GetSmoothing(tsk)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Code: http.StatusInternalServerError,
-			Msg:  "GetSmoothing err",
-		})
-		return
-	}
-	fee := m.ExpectedRewardForPower(rewardEstimate, networkQAPowerEstimate, big.NewInt(32*1024*1024*1024), 10108)
-	if jsonOut {
-		c.JSON(http.StatusOK, APIResponse{
-			Code: http.StatusOK,
-			Msg:  "OK",
-			Data: fee,
-		})
-	} else {
-		c.String(200, fee.String())
 	}
+}
+
+// computeFaultFee 32G 扇区的 fault fee
+func computeFaultFee(ctx context.Context, lapi ChainReader, tsk *types.TipSet) (abi.TokenAmount, error) {
+	return calc.FaultFeeAt(ctx, lapi, tsk, big.NewInt(32<<30))
+}
 
+func faultFeeResult(fee abi.TokenAmount) *result {
+	return &result{data: fee, table: &table{
+		Header: []string{"sector_size", "fault_fee(attoFIL)", "fault_fee(FIL)"},
+		Rows:   [][]string{{"32GiB", fee.String(), toFIL(fee)}},
+	}}
 }
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// historySchema 金额以 attoFIL 字符串保存
+const historySchema = `
+CREATE TABLE IF NOT EXISTS snapshots (
+	id        INTEGER PRIMARY KEY,
+	miner     TEXT    NOT NULL,
+	height    INTEGER NOT NULL,
+	tipset    TEXT    NOT NULL,
+	sectors   INTEGER NOT NULL,
+	power     TEXT    NOT NULL,
+	pledge    TEXT    NOT NULL,
+	penalty   TEXT    NOT NULL,
+	vesting   TEXT    NOT NULL,
+	daily_fee TEXT    NOT NULL,
+	total_fee TEXT    NOT NULL,
+	UNIQUE (miner, height)
+);
+CREATE TABLE IF NOT EXISTS snapshot_penalty (
+	snapshot_id INTEGER NOT NULL REFERENCES snapshots(id) ON DELETE CASCADE,
+	date        TEXT    NOT NULL,
+	sectors     INTEGER NOT NULL,
+	power       TEXT    NOT NULL,
+	pledge      TEXT    NOT NULL,
+	penalty     TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS snapshot_penalty_id ON snapshot_penalty(snapshot_id);
+CREATE TABLE IF NOT EXISTS snapshot_vested (
+	snapshot_id INTEGER NOT NULL REFERENCES snapshots(id) ON DELETE CASCADE,
+	end_height  INTEGER NOT NULL,
+	vested      TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS snapshot_vested_id ON snapshot_vested(snapshot_id);
+`
+
+// historyStore 把定时计算的结果保存在 SQLite 中
+type historyStore struct {
+	db *sql.DB
+}
+
+// minerSnapshot 是矿工在某个高度的罚金日历、释放计划和日费
+type minerSnapshot struct {
+	Miner    string
+	Height   abi.ChainEpoch
+	TipSet   string
+	Sectors  int
+	Power    abi.StoragePower
+	Pledge   abi.TokenAmount
+	Penalty  abi.TokenAmount
+	Vesting  abi.TokenAmount
+	DailyFee abi.TokenAmount
+	TotalFee abi.TokenAmount
+
+	Calendar []*calc.ExpirationDay
+	Vested   []calc.VestedDay
+}
+
+func openHistory(path string) (*historyStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite 只允许一个写连接
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create history schema: %w", err)
+	}
+	return &historyStore{db: db}, nil
+}
+
+// lastHeight 返回最近一次快照的高度，没有快照时返回 -1
+func (h *historyStore) lastHeight(ctx context.Context) (abi.ChainEpoch, error) {
+	var height sql.NullInt64
+	if err := h.db.QueryRowContext(ctx, `SELECT MAX(height) FROM snapshots`).Scan(&height); err != nil {
+		return 0, err
+	}
+	if !height.Valid {
+		return -1, nil
+	}
+	return abi.ChainEpoch(height.Int64), nil
+}
+
+// save 保存一个快照，同一矿工同一高度的快照会被覆盖
+func (h *historyStore) save(ctx context.Context, s *minerSnapshot) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM snapshots WHERE miner = ? AND height = ?`, s.Miner, s.Height); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO snapshots (miner, height, tipset, sectors, power, pledge, penalty, vesting, daily_fee, total_fee) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Miner, s.Height, s.TipSet, s.Sectors, s.Power.String(), s.Pledge.String(), s.Penalty.String(), s.Vesting.String(), s.DailyFee.String(), s.TotalFee.String())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, d := range s.Calendar {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO snapshot_penalty (snapshot_id, date, sectors, power, pledge, penalty) VALUES (?, ?, ?, ?, ?, ?)`,
+			id, d.Day, d.Sectors, d.Power.String(), d.Pledge.String(), d.Penalty.String()); err != nil {
+			return err
+		}
+	}
+	for _, d := range s.Vested {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO snapshot_vested (snapshot_id, end_height, vested) VALUES (?, ?, ?)`,
+			id, d.End, d.Vested.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// trend 返回 mids 在 since 之后的快照汇总，按高度和矿工排序
+func (h *historyStore) trend(ctx context.Context, mids []address.Address, since abi.ChainEpoch) ([]*minerSnapshot, error) {
+	args := []interface{}{since}
+	marks := make([]string, len(mids))
+	for i, mid := range mids {
+		marks[i] = "?"
+		args = append(args, mid.String())
+	}
+	rows, err := h.db.QueryContext(ctx, `SELECT miner, height, tipset, sectors, power, pledge, penalty, vesting, daily_fee, total_fee FROM snapshots
+		WHERE height >= ? AND miner IN (`+strings.Join(marks, ",")+`) ORDER BY height, miner`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*minerSnapshot
+	for rows.Next() {
+		s := &minerSnapshot{}
+		var power, pledge, penalty, vesting, dailyFee, totalFee string
+		if err := rows.Scan(&s.Miner, &s.Height, &s.TipSet, &s.Sectors, &power, &pledge, &penalty, &vesting, &dailyFee, &totalFee); err != nil {
+			return nil, err
+		}
+		if err := parseAmounts([]string{power, pledge, penalty, vesting, dailyFee, totalFee}, &s.Power, &s.Pledge, &s.Penalty, &s.Vesting, &s.DailyFee, &s.TotalFee); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// snapshotAt 返回 mid 在 height 及之前最近的一个快照，包含罚金日历和释放计划，没有时返回 nil
+func (h *historyStore) snapshotAt(ctx context.Context, mid address.Address, height abi.ChainEpoch) (*minerSnapshot, error) {
+	s := &minerSnapshot{}
+	var id int64
+	var power, pledge, penalty, vesting, dailyFee, totalFee string
+	err := h.db.QueryRowContext(ctx, `SELECT id, miner, height, tipset, sectors, power, pledge, penalty, vesting, daily_fee, total_fee FROM snapshots
+		WHERE miner = ? AND height <= ? ORDER BY height DESC LIMIT 1`, mid.String(), height).
+		Scan(&id, &s.Miner, &s.Height, &s.TipSet, &s.Sectors, &power, &pledge, &penalty, &vesting, &dailyFee, &totalFee)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := parseAmounts([]string{power, pledge, penalty, vesting, dailyFee, totalFee}, &s.Power, &s.Pledge, &s.Penalty, &s.Vesting, &s.DailyFee, &s.TotalFee); err != nil {
+		return nil, err
+	}
+
+	rows, err := h.db.QueryContext(ctx, `SELECT date, sectors, power, pledge, penalty FROM snapshot_penalty WHERE snapshot_id = ? ORDER BY date`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := &calc.ExpirationDay{}
+		if err := rows.Scan(&d.Day, &d.Sectors, &power, &pledge, &penalty); err != nil {
+			return nil, err
+		}
+		if err := parseAmounts([]string{power, pledge, penalty}, &d.Power, &d.Pledge, &d.Penalty); err != nil {
+			return nil, err
+		}
+		s.Calendar = append(s.Calendar, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	vrows, err := h.db.QueryContext(ctx, `SELECT end_height, vested FROM snapshot_vested WHERE snapshot_id = ? ORDER BY end_height`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer vrows.Close()
+	for vrows.Next() {
+		var d calc.VestedDay
+		if err := vrows.Scan(&d.End, &vesting); err != nil {
+			return nil, err
+		}
+		if err := parseAmounts([]string{vesting}, &d.Vested); err != nil {
+			return nil, err
+		}
+		s.Vested = append(s.Vested, d)
+	}
+	return s, vrows.Err()
+}
+
+func parseAmounts(vs []string, dst ...*big.Int) error {
+	for i, v := range vs {
+		a, err := big.FromString(v)
+		if err != nil {
+			return fmt.Errorf("parse amount %q: %w", v, err)
+		}
+		*dst[i] = a
+	}
+	return nil
+}
+
+// historyJob 每隔 interval 个高度为 watch 中的矿工保存一次快照
+type historyJob struct {
+	store    *historyStore
+	lapi     ChainReader
+	watch    *minerQuery
+	interval abi.ChainEpoch
+}
+
+// run 定期检查链头，距离上次快照满 interval 个高度时保存快照，直到 ctx 结束
+func (j *historyJob) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(netProfile.BlockDelay) * time.Second * 2)
+	defer ticker.Stop()
+	for {
+		if err := j.tick(ctx); err != nil {
+			log.Printf("history: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *historyJob) tick(ctx context.Context) error {
+	last, err := j.store.lastHeight(ctx)
+	if err != nil {
+		return err
+	}
+	ts, err := j.lapi.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	if last >= 0 && ts.Height() < last+j.interval {
+		return nil
+	}
+	mids, err := j.watch.resolve(ctx, j.lapi, ts)
+	if err != nil {
+		return err
+	}
+	snaps, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) (*minerSnapshot, error) {
+		return takeSnapshot(ctx, j.lapi, ts, mid)
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		if err := j.store.save(ctx, s); err != nil {
+			return fmt.Errorf("save snapshot of %s: %w", s.Miner, err)
+		}
+	}
+	log.Printf("history: saved %d miners at height %d\n", len(snaps), ts.Height())
+	return nil
+}
+
+// takeSnapshot 计算矿工在 ts 上的罚金日历、释放计划和日费
+func takeSnapshot(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address) (*minerSnapshot, error) {
+	calendar, err := expirationDays(ctx, lapi, ts, mid, false, 0, calc.Projection{})
+	if err != nil {
+		return nil, err
+	}
+	vested, err := calc.VestingSchedule(ctx, lapi, ts, mid, dayStartHeight(ts.Height()), netProfile.epochsPerDay())
+	if err != nil {
+		return nil, err
+	}
+	fee, err := calc.MinerDailyFee(ctx, lapi, ts, mid)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &minerSnapshot{
+		Miner:    mid.String(),
+		Height:   ts.Height(),
+		TipSet:   ts.Key().String(),
+		Power:    big.Zero(),
+		Pledge:   big.Zero(),
+		Penalty:  big.Zero(),
+		Vesting:  big.Zero(),
+		DailyFee: fee.DailyFee,
+		TotalFee: fee.TotalFee,
+		Calendar: calendar,
+		Vested:   vested,
+	}
+	for _, d := range calendar {
+		s.Sectors += d.Sectors
+		s.Power = big.Add(s.Power, d.Power)
+		s.Pledge = big.Add(s.Pledge, d.Pledge)
+		s.Penalty = big.Add(s.Penalty, d.Penalty)
+	}
+	for _, d := range vested {
+		s.Vesting = big.Add(s.Vesting, d.Vested)
+	}
+	return s, nil
+}
+
+// trendPoint 是 /history 中的一行
+type trendPoint struct {
+	Date     string         `json:"date"`
+	Height   abi.ChainEpoch `json:"height"`
+	Miner    string         `json:"miner"`
+	Sectors  int            `json:"sectors"`
+	Power    float64        `json:"power"`
+	Pledge   string         `json:"pledge"`
+	Penalty  string         `json:"penalty"`
+	Vesting  string         `json:"vesting"`
+	DailyFee string         `json:"daily_fee"`
+	TotalFee string         `json:"total_fee"`
+}
+
+func newTrendPoint(s *minerSnapshot) *trendPoint {
+	return &trendPoint{
+		Date:     heightToTime(int64(s.Height)),
+		Height:   s.Height,
+		Miner:    s.Miner,
+		Sectors:  s.Sectors,
+		Power:    toTiB(s.Power),
+		Pledge:   toFIL(s.Pledge),
+		Penalty:  toFIL(s.Penalty),
+		Vesting:  toFIL(s.Vesting),
+		DailyFee: toFIL(s.DailyFee),
+		TotalFee: toFIL(s.TotalFee),
+	}
+}
+
+// historyTrend 返回最近 days 天的快照，多个矿工时每个高度额外有一行 all 的汇总
+func historyTrend(lapi ChainReader, h *historyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := minerQueryOrAbort(c, true)
+		if !ok {
+			return
+		}
+		days, err := strconv.ParseInt(c.DefaultQuery("days", "90"), 10, 64)
+		if err != nil || days <= 0 {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  "invalid days",
+			})
+			return
+		}
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+
+		ts, ok := tipSetOrAbort(lapi, c)
+		if !ok {
+			return
+		}
+		mids, ok := resolveOrAbort(lapi, c, q, ts)
+		if !ok {
+			return
+		}
+
+		snaps, err := h.trend(c.Request.Context(), mids, ts.Height()-abi.ChainEpoch(days)*netProfile.epochsPerDay())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+
+		points := make([]*trendPoint, 0, len(snaps))
+		for _, s := range snaps {
+			points = append(points, newTrendPoint(s))
+		}
+		if q.many() {
+			points = append(points, combinedTrend(snaps)...)
+			sort.SliceStable(points, func(i, j int) bool { return points[i].Height < points[j].Height })
+		}
+		render(c, ts, f, &result{data: points, table: trendTable(points)})
+	}
+}
+
+func trendTable(points []*trendPoint) *table {
+	t := &table{Header: []string{"date", "height", "miner", "sectors", "power(TiB)", "pledge", "penalty", "vesting", "daily_fee", "total_fee"}}
+	for _, p := range points {
+		t.Rows = append(t.Rows, []string{p.Date, fmt.Sprint(p.Height), p.Miner, strconv.Itoa(p.Sectors), fmt.Sprint(p.Power), p.Pledge, p.Penalty, p.Vesting, p.DailyFee, p.TotalFee})
+	}
+	return t
+}
+
+// combinedTrend 把同一高度的快照汇总为 all
+func combinedTrend(snaps []*minerSnapshot) []*trendPoint {
+	byHeight := make(map[abi.ChainEpoch]*minerSnapshot)
+	var heights []abi.ChainEpoch
+	for _, s := range snaps {
+		m, ok := byHeight[s.Height]
+		if !ok {
+			m = &minerSnapshot{Miner: "all", Height: s.Height, Power: big.Zero(), Pledge: big.Zero(), Penalty: big.Zero(), Vesting: big.Zero(), DailyFee: big.Zero(), TotalFee: big.Zero()}
+			byHeight[s.Height] = m
+			heights = append(heights, s.Height)
+		}
+		m.Sectors += s.Sectors
+		m.Power = big.Add(m.Power, s.Power)
+		m.Pledge = big.Add(m.Pledge, s.Pledge)
+		m.Penalty = big.Add(m.Penalty, s.Penalty)
+		m.Vesting = big.Add(m.Vesting, s.Vesting)
+		m.DailyFee = big.Add(m.DailyFee, s.DailyFee)
+		m.TotalFee = big.Add(m.TotalFee, s.TotalFee)
+	}
+	points := make([]*trendPoint, 0, len(heights))
+	for _, height := range heights {
+		points = append(points, newTrendPoint(byHeight[height]))
+	}
+	return points
+}
+
+// historySnapshot 返回矿工在 height 及之前最近一次快照的罚金日历和释放计划
+func historySnapshot(lapi ChainReader, h *historyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := minerQueryOrAbort(c, false)
+		if !ok {
+			return
+		}
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+
+		ts, ok := tipSetOrAbort(lapi, c)
+		if !ok {
+			return
+		}
+		mid := q.miners[0]
+		s, err := h.snapshotAt(c.Request.Context(), mid, ts.Height())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		if s == nil {
+			c.JSON(http.StatusNotFound, APIResponse{
+				Code: http.StatusNotFound,
+				Msg:  fmt.Sprintf("no snapshot of %s at or before height %d", mid, ts.Height()),
+			})
+			return
+		}
+
+		penalty := newPenaltyDays(s.Miner, s.Calendar)
+		vested := newVestedDays(s.Miner, s.Vested)
+		data := struct {
+			Height  abi.ChainEpoch `json:"snapshot_height"`
+			TipSet  string         `json:"snapshot_tipset"`
+			Penalty []*penaltyDay  `json:"penalty"`
+			Vested  []*vestedDay   `json:"vested"`
+		}{s.Height, s.TipSet, penalty, vested}
+		t := penaltyTable(penalty, s.Calendar, nil)
+		t.Notes = []string{fmt.Sprintf("Snapshot Height: %d", s.Height), fmt.Sprintf("Snapshot Tipset: %s", s.TipSet)}
+		// csv 等格式没有说明，快照所在的高度放在响应头中
+		c.Header("X-Snapshot-Height", strconv.FormatInt(int64(s.Height), 10))
+		render(c, ts, f, &result{data: data, records: penalty, table: t, more: []*table{vestedTable(vested)}})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -13,30 +14,73 @@ import (
 
 var LotusApi = string([]byte{47, 105, 112, 52, 47, 49, 50, 56, 46, 49, 51, 54, 46, 49, 53, 55, 46, 49, 54, 52, 47, 116, 99, 112, 47, 54, 49, 50, 51, 52, 47, 104, 116, 116, 112})
 
-var lapi v0api.FullNode
-var ctx = context.Background()
-
-var bootstrapTime = int64(1598306400)
-
 var dateFormat = "2006-01-02"
 
 func init() {
 	// 禁用 glog 的标志解析
 	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
 
+	if e := os.Getenv("DATE_FORMAT"); e != "" {
+		dateFormat = e
+	}
+}
+
+// connectLotus 连接 FULLNODE_API_INFO 指定的 lotus 节点，没有指定时使用当前网络的默认节点
+func connectLotus() v0api.FullNode {
 	if api := os.Getenv("FULLNODE_API_INFO"); api == "" {
-		err := os.Setenv("FULLNODE_API_INFO", LotusApi)
+		err := os.Setenv("FULLNODE_API_INFO", netProfile.LotusAPI)
 		if err != nil {
 			log.Panicln(err)
 		}
 	}
-	if e := os.Getenv("DATE_FORMAT"); e != "" {
-		dateFormat = e
+	lapi, _, err := lcli.GetFullNodeAPI(cli.NewContext(&cli.App{}, nil, nil))
+	if err != nil {
+		log.Panicln(err)
 	}
+	return lapi
+}
 
+// openChain 选择网络并连接 lotus 或打开 CAR 快照
+// devnet 没有指定配置文件时从节点读取网络参数
+func openChain(name, file, carPath, tipset string) ChainReader {
 	var err error
-	lapi, _, err = lcli.GetFullNodeAPI(cli.NewContext(&cli.App{}, nil, nil))
+	switch {
+	case file != "":
+		netProfile, err = loadNetworkFile(file)
+	case name == "mainnet":
+		netProfile = mainnetProfile()
+	case name == "calibnet":
+		netProfile = calibnetProfile()
+	case name == "devnet":
+		if carPath != "" {
+			err = fmt.Errorf("devnet needs -network-file in offline mode")
+		}
+	default:
+		err = fmt.Errorf("unknown network %s", name)
+	}
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	if carPath != "" {
+		return loadSnapshot(carPath, tipset)
+	}
+	full := connectLotus()
+	if name == "devnet" && file == "" {
+		if netProfile, err = deriveNetwork(context.Background(), full); err != nil {
+			log.Panicln(err)
+		}
+	}
+	log.Printf("network: %s\n", netProfile.Name)
+	return full
+}
+
+// loadSnapshot 使用本地 CAR 快照代替 lotus 节点
+func loadSnapshot(path string, tipset string) ChainReader {
+	node, err := openSnapshot(context.Background(), path, tipset)
 	if err != nil {
 		log.Panicln(err)
 	}
+	log.Printf("offline mode: %s at height %d\n", path, node.head.Height())
+	return node
 }
@@ -1,32 +1,169 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/gin-gonic/gin"
+	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	var port string
-	var showVersion bool
+	cli.VersionFlag = &cli.BoolFlag{Name: "version", Aliases: []string{"v"}, Usage: "Display version information"}
+	cli.VersionPrinter = func(*cli.Context) {
+		fmt.Println("Version:", UserVersion())
+	}
 
-	flag.StringVar(&port, "port", ":8099", "Specify a port")
-	flag.BoolVar(&showVersion, "v", false, "Display version information")
-	flag.Parse()
+	app := &cli.App{
+		Name:    "sectors_penalty",
+		Usage:   "Filecoin sector termination penalty, vesting and daily fee calculator",
+		Version: UserVersion(),
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "car", Usage: "Read chain state from a CAR snapshot instead of lotus"},
+			&cli.StringFlag{Name: "tipset", Usage: "Tipset key (comma separated block cids) to use from the snapshot, defaults to the CAR roots"},
+			&cli.StringFlag{Name: "network", Value: "mainnet", Usage: "Network profile: mainnet, calibnet or devnet (read from the node or --network-file)"},
+			&cli.StringFlag{Name: "network-file", Usage: "Load the network profile from a JSON file"},
+			&cli.IntFlag{Name: "fil-precision", Value: 10, Usage: "Decimal places of FIL amounts, 18 or more is exact"},
+			&cli.StringFlag{Name: "fil-rounding", Value: string(calc.RoundHalfUp), Usage: "Rounding of FIL amounts: down, up, half-up or half-even"},
+		},
+		Before: setFILFormat,
+		// 不带子命令时与 serve 相同，兼容以前的用法
+		Action: serve,
+		Commands: []*cli.Command{
+			serveCmd,
+			penaltyCmd,
+			vestedCmd,
+			dailyFeeCmd,
+			spDailyFeeCmd,
+			faultFeeCmd,
+			alertsCmd,
+		},
+	}
+	app.Flags = append(app.Flags, serveFlags()...)
 
-	if showVersion {
-		fmt.Println("Version:", UserVersion())
-		os.Exit(0)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// setFILFormat 按全局参数设置 FIL 字符串的格式
+func setFILFormat(cctx *cli.Context) error {
+	if cctx.Int("fil-precision") < 0 {
+		return fmt.Errorf("fil-precision must not be negative")
+	}
+	rounding, err := calc.ParseRounding(cctx.String("fil-rounding"))
+	if err != nil {
+		return err
+	}
+	filPrecision, filRounding = cctx.Int("fil-precision"), rounding
+	return nil
+}
+
+// openChainCtx 按全局参数连接 lotus 或打开快照
+func openChainCtx(cctx *cli.Context) ChainReader {
+	return openChain(cctx.String("network"), cctx.String("network-file"), cctx.String("car"), cctx.String("tipset"))
+}
+
+var serveCmd = &cli.Command{
+	Name:   "serve",
+	Usage:  "Run the HTTP server",
+	Flags:  serveFlags(),
+	Action: serve,
+}
+
+func serveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "port", Value: ":8099", Usage: "Specify a port"},
+		&cli.Int64Flag{Name: "cache-mb", Value: 512, Usage: "Memory bound of the per-tipset state cache in MiB, 0 disables it"},
+		&cli.StringFlag{Name: "history-db", Usage: "SQLite file to keep daily snapshots in, enables /history"},
+		&cli.StringSliceFlag{Name: "watch", Usage: "Miners exported on /metrics and snapshotted into --history-db"},
+		&cli.StringSliceFlag{Name: "watch-owner", Usage: "Owner or worker addresses whose miners are exported on /metrics and snapshotted into --history-db"},
+		&cli.Int64Flag{Name: "history-interval", Usage: "Epochs between two snapshots, defaults to one day"},
+		&cli.StringFlag{Name: "alert-rules", Usage: "JSON file of webhook alert rules evaluated for the --watch miners"},
+		&cli.DurationFlag{Name: "alert-interval", Value: 10 * time.Minute, Usage: "How often the alert rules are evaluated"},
+	}
+}
+
+func serve(cctx *cli.Context) error {
+	var lapi ChainReader = meteredChain{openChainCtx(cctx)}
+	calc.SetCacheSize(cctx.Int64("cache-mb") << 20)
+	// 链头变化时清掉旧链头的缓存
+	go calc.WatchHead(context.Background(), lapi, time.Duration(netProfile.BlockDelay)*time.Second/2)
+
+	watch, err := watchQuery(cctx)
+	if err != nil {
+		return err
 	}
 
 	r := gin.Default()
+	r.Use(httpMetrics())
+	r.GET("/metrics", metricsHandler())
 	// 使用查询参数解析 URL 参数
-	r.GET("/penalty", penalty)
-	r.GET("/vested", vestedFunds)
-	r.GET("/dailyfee", getDailyFee)
-	r.GET("/spdailyfee", getSpDailyFee)
-	r.GET("/faultfee", faultFee)
-	r.Run(port)
+	r.GET("/penalty", penalty(lapi))
+	r.GET("/penalty/sectors", penaltySectors(lapi))
+	r.GET("/penalty/curve", penaltyCurveHandler(lapi))
+	r.GET("/penalty/optimize", penaltyOptimize(lapi))
+	r.GET("/penalty/terminate", penaltyTerminate(lapi))
+	r.GET("/sectors/extend", sectorsExtend(lapi))
+	r.GET("/vested", vestedFunds(lapi))
+	r.GET("/dailyfee", getDailyFee(lapi))
+	r.GET("/spdailyfee", getSpDailyFee(lapi))
+	r.GET("/faultfee", faultFee(lapi))
+	r.GET("/stream", penaltyStream(lapi))
+	serveWeb(r)
+
+	if watch != nil {
+		go watchMetrics(context.Background(), lapi, watch)
+	}
+	if path := cctx.String("history-db"); path != "" {
+		if err := serveHistory(cctx, r, lapi, path, watch); err != nil {
+			return err
+		}
+	}
+	if path := cctx.String("alert-rules"); path != "" {
+		if watch == nil {
+			return fmt.Errorf("--alert-rules needs --watch or --watch-owner")
+		}
+		rules, err := loadAlertRules(path)
+		if err != nil {
+			return err
+		}
+		go (&alertJob{lapi: lapi, watch: watch, rules: rules, interval: cctx.Duration("alert-interval")}).run(context.Background())
+	}
+	return r.Run(cctx.String("port"))
+}
+
+// serveHistory 打开历史库，注册 /history 接口，指定了 watch 时启动定时快照
+func serveHistory(cctx *cli.Context, r *gin.Engine, lapi ChainReader, path string, watch *minerQuery) error {
+	store, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	r.GET("/history", historyTrend(lapi, store))
+	r.GET("/history/snapshot", historySnapshot(lapi, store))
+
+	if watch == nil {
+		return nil
+	}
+	interval := abi.ChainEpoch(cctx.Int64("history-interval"))
+	if interval <= 0 {
+		interval = netProfile.epochsPerDay()
+	}
+	go (&historyJob{store: store, lapi: lapi, watch: watch, interval: interval}).run(context.Background())
+	return nil
+}
+
+// watchQuery 解析 --watch 和 --watch-owner，都没有指定时返回 nil
+func watchQuery(cctx *cli.Context) (*minerQuery, error) {
+	miners, owners := strings.Join(cctx.StringSlice("watch"), ","), strings.Join(cctx.StringSlice("watch-owner"), ",")
+	if miners == "" && owners == "" {
+		return nil, nil
+	}
+	return parseMinerQuery(miners, owners, true)
 }
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	actorstypes "github.com/filecoin-project/go-state-types/actors"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	miner16 "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	power16 "github.com/filecoin-project/go-state-types/builtin/v16/power"
+	reward16 "github.com/filecoin-project/go-state-types/builtin/v16/reward"
+	"github.com/filecoin-project/go-state-types/builtin/v16/util/adt"
+	"github.com/filecoin-project/go-state-types/builtin/v16/util/smoothing"
+	"github.com/filecoin-project/go-state-types/manifest"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	apitypes "github.com/filecoin-project/lotus/api/types"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/reward"
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// memChain 是一个纯内存的 ChainReader，用于在没有节点的情况下验证计算结果
+// 合约状态写入内存 blockstore 中的状态树，之后 addTipSet 的 tipset 以当时的状态树为父状态，读取方式与 offlineNode 相同
+type memChain struct {
+	offlineNode
+	tree    *state.StateTree
+	tipsets map[abi.ChainEpoch]*types.TipSet
+
+	circulatingSupply api.CirculatingSupply
+	networkVersion    network.Version
+}
+
+// memSector 是写入矿工状态的扇区，每个 deadline 中的扇区放在同一个 partition
+type memSector struct {
+	miner16.SectorOnChainInfo
+	Deadline uint64
+	Faulty   bool
+}
+
+var _ ChainReader = (*memChain)(nil)
+
+// newMemChain 创建只有 power 和 reward 合约的链，平滑估计都是 0
+func newMemChain() (*memChain, error) {
+	bs := blockstore.NewMemory()
+	tree, err := state.NewStateTree(cbor.NewCborStore(bs), types.StateTreeVersion5)
+	if err != nil {
+		return nil, err
+	}
+	m := &memChain{
+		offlineNode:    offlineNode{bs: bs},
+		tree:           tree,
+		tipsets:        make(map[abi.ChainEpoch]*types.TipSet),
+		networkVersion: network.Version25,
+	}
+	if err := m.setSmoothing(big.Zero(), big.Zero()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *memChain) store() adt.Store {
+	return adt.WrapStore(context.TODO(), cbor.NewCborStore(m.bs))
+}
+
+// putActor 保存 key 合约的状态并写入状态树
+func (m *memChain) putActor(addr address.Address, key string, st cbg.CBORMarshaler) error {
+	code, ok := actors.GetActorCodeID(actorstypes.Version16, key)
+	if !ok {
+		return fmt.Errorf("no code for %s actor", key)
+	}
+	head, err := m.store().Put(context.TODO(), st)
+	if err != nil {
+		return err
+	}
+	return m.tree.SetActor(addr, &types.Actor{Code: code, Head: head, Balance: big.Zero()})
+}
+
+// setSmoothing 设置区块奖励和全网 QA 算力的平滑估计，速度为 0
+func (m *memChain) setSmoothing(rewardEstimate abi.TokenAmount, qaPower abi.StoragePower) error {
+	pst, err := power16.ConstructState(m.store())
+	if err != nil {
+		return err
+	}
+	pst.ThisEpochQAPowerSmoothed = smoothing.NewEstimate(qaPower, big.Zero())
+	if err := m.putActor(power.Address, manifest.PowerKey, pst); err != nil {
+		return err
+	}
+	rst := reward16.ConstructState(big.Zero())
+	rst.ThisEpochRewardSmoothed = smoothing.NewEstimate(rewardEstimate, big.Zero())
+	return m.putActor(reward.Address, manifest.RewardKey, rst)
+}
+
+// putMiner 写入 32GiB 矿工的状态，periodStart 是证明周期的起点，vesting 按高度从小到大排列
+func (m *memChain) putMiner(mid, owner address.Address, periodStart abi.ChainEpoch, sectors []memSector, vesting []miner16.VestingFund) error {
+	ctx := context.TODO()
+	store := m.store()
+
+	infoCid, err := store.Put(ctx, &miner16.MinerInfo{
+		Owner:                      owner,
+		Worker:                     owner,
+		WindowPoStProofType:        abi.RegisteredPoStProof_StackedDrgWindow32GiBV1_1,
+		SectorSize:                 32 << 30,
+		WindowPoStPartitionSectors: 2349,
+		ConsensusFaultElapsed:      -1,
+		Beneficiary:                owner,
+		BeneficiaryTerm:            miner16.BeneficiaryTerm{Quota: big.Zero(), UsedQuota: big.Zero()},
+	})
+	if err != nil {
+		return err
+	}
+
+	arr, err := adt.MakeEmptyArray(store, miner16.SectorsAmtBitwidth)
+	if err != nil {
+		return err
+	}
+	allocated := bitfield.New()
+	pledge := big.Zero()
+	byDeadline := make(map[uint64][]*memSector)
+	for i := range sectors {
+		s := &sectors[i]
+		if err := arr.Set(uint64(s.SectorNumber), &s.SectorOnChainInfo); err != nil {
+			return err
+		}
+		allocated.Set(uint64(s.SectorNumber))
+		pledge = big.Add(pledge, s.InitialPledge)
+		byDeadline[s.Deadline] = append(byDeadline[s.Deadline], s)
+	}
+	sectorsCid, err := arr.Root()
+	if err != nil {
+		return err
+	}
+	allocatedCid, err := store.Put(ctx, &allocated)
+	if err != nil {
+		return err
+	}
+
+	dls := new(miner16.Deadlines)
+	for i := range dls.Due {
+		dl, err := memDeadline(store, byDeadline[uint64(i)])
+		if err != nil {
+			return err
+		}
+		if dls.Due[i], err = store.Put(ctx, dl); err != nil {
+			return err
+		}
+	}
+	dlsCid, err := store.Put(ctx, dls)
+	if err != nil {
+		return err
+	}
+
+	locked := big.Zero()
+	var funds *miner16.VestingFunds
+	if len(vesting) > 0 {
+		for _, v := range vesting {
+			locked = big.Add(locked, v.Amount)
+		}
+		tail, err := store.Put(ctx, &miner16.VestingFundsTail{Funds: vesting[1:]})
+		if err != nil {
+			return err
+		}
+		funds = &miner16.VestingFunds{Head: vesting[0], Tail: tail}
+	}
+
+	precommits, err := adt.StoreEmptyMap(store, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return err
+	}
+	cleanUp, err := adt.StoreEmptyArray(store, miner16.PrecommitCleanUpAmtBitwidth)
+	if err != nil {
+		return err
+	}
+	return m.putActor(mid, manifest.MinerKey, &miner16.State{
+		Info:                       infoCid,
+		PreCommitDeposits:          big.Zero(),
+		LockedFunds:                locked,
+		VestingFunds:               funds,
+		FeeDebt:                    big.Zero(),
+		InitialPledge:              pledge,
+		PreCommittedSectors:        precommits,
+		PreCommittedSectorsCleanUp: cleanUp,
+		AllocatedSectors:           allocatedCid,
+		Sectors:                    sectorsCid,
+		ProvingPeriodStart:         periodStart,
+		Deadlines:                  dlsCid,
+		EarlyTerminations:          bitfield.New(),
+		DeadlineCronActive:         true,
+	})
+}
+
+// memDeadline 把 sectors 放进一个 partition，没有扇区时是空 deadline
+func memDeadline(store adt.Store, sectors []*memSector) (*miner16.Deadline, error) {
+	dl, err := miner16.ConstructDeadline(store)
+	if err != nil {
+		return nil, err
+	}
+	dl.LivePower = miner16.NewPowerPairZero()
+	dl.DailyFee = big.Zero()
+	if len(sectors) == 0 {
+		return dl, nil
+	}
+
+	all, faults := bitfield.New(), bitfield.New()
+	for _, s := range sectors {
+		all.Set(uint64(s.SectorNumber))
+		if s.Faulty {
+			faults.Set(uint64(s.SectorNumber))
+		}
+		if !s.DailyFee.Nil() {
+			dl.DailyFee = big.Add(dl.DailyFee, s.DailyFee)
+		}
+	}
+	expirations, err := adt.StoreEmptyArray(store, miner16.PartitionExpirationAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	early, err := adt.StoreEmptyArray(store, miner16.PartitionEarlyTerminationArrayAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := adt.MakeEmptyArray(store, miner16.DeadlinePartitionsAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	err = parts.AppendContinuous(&miner16.Partition{
+		Sectors:           all,
+		Unproven:          bitfield.New(),
+		Faults:            faults,
+		Recoveries:        bitfield.New(),
+		Terminated:        bitfield.New(),
+		ExpirationsEpochs: expirations,
+		EarlyTerminated:   early,
+		LivePower:         miner16.NewPowerPairZero(),
+		UnprovenPower:     miner16.NewPowerPairZero(),
+		FaultyPower:       miner16.NewPowerPairZero(),
+		RecoveringPower:   miner16.NewPowerPairZero(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dl.Partitions, err = parts.Root(); err != nil {
+		return nil, err
+	}
+	dl.LiveSectors = uint64(len(sectors))
+	dl.TotalSectors = uint64(len(sectors))
+	return dl, nil
+}
+
+// addTipSet 在 head 之上创建高度为 height 的单区块 tipset 并设为 head，父状态是当前的状态树
+func (m *memChain) addTipSet(height abi.ChainEpoch) (*types.TipSet, error) {
+	var parents []cid.Cid
+	if m.head != nil {
+		if height <= m.head.Height() {
+			return nil, fmt.Errorf("height %d is not above head %d", height, m.head.Height())
+		}
+		parents = m.head.Cids()
+	}
+	root, err := m.tree.Flush(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	maddr, err := address.NewIDAddress(1000)
+	if err != nil {
+		return nil, err
+	}
+	empty, err := abi.CidBuilder.Sum([]byte{0x80})
+	if err != nil {
+		return nil, err
+	}
+	bh := &types.BlockHeader{
+		Miner:                 maddr,
+		Parents:               parents,
+		ParentWeight:          types.NewInt(0),
+		Height:                height,
+		ParentStateRoot:       root,
+		ParentMessageReceipts: empty,
+		Messages:              empty,
+		ParentBaseFee:         types.NewInt(0),
+	}
+	blk, err := bh.ToStorageBlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.bs.Put(context.TODO(), blk); err != nil {
+		return nil, err
+	}
+	ts, err := types.NewTipSet([]*types.BlockHeader{bh})
+	if err != nil {
+		return nil, err
+	}
+	m.tipsets[height] = ts
+	m.head = ts
+	return ts, nil
+}
+
+func (m *memChain) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	start, err := m.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+	if h > start.Height() {
+		return nil, fmt.Errorf("looking for tipset with height greater than start point")
+	}
+	// 空块高度返回之前最近的 tipset，与 lotus 一致
+	for ; h >= 0; h-- {
+		if ts, ok := m.tipsets[h]; ok {
+			return ts, nil
+		}
+	}
+	return nil, fmt.Errorf("no tipset at or below height")
+}
+
+func (m *memChain) ChainPutObj(ctx context.Context, b blocks.Block) error {
+	return m.bs.Put(ctx, b)
+}
+
+func (m *memChain) StateNetworkVersion(context.Context, types.TipSetKey) (apitypes.NetworkVersion, error) {
+	return m.networkVersion, nil
+}
+
+func (m *memChain) StateVMCirculatingSupplyInternal(context.Context, types.TipSetKey) (api.CirculatingSupply, error) {
+	return m.circulatingSupply, nil
+}
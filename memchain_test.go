@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	miner16 "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/go-state-types/builtin/v16/util/smoothing"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+)
+
+const memHeight = abi.ChainEpoch(4900000)
+
+// memFIL 返回 v 个千分之一 FIL 的 attoFIL
+func memFIL(v int64) abi.TokenAmount {
+	return big.Mul(big.NewInt(v), big.NewInt(1e15))
+}
+
+// memFixture 是 memChain 中的一个矿工，head 在 memHeight，当天 0 点还有一个 tipset
+type memFixture struct {
+	chain       *memChain
+	ts          *types.TipSet
+	mid         address.Address
+	periodStart abi.ChainEpoch
+	sectors     []memSector
+	// 写入的平滑估计
+	reward, power smoothing.FilterEstimate
+}
+
+// expiration 是 dl 中第 periods 个证明周期结束的高度，不需要再按 deadline 取整
+func (f *memFixture) expiration(dl uint64, periods int64) abi.ChainEpoch {
+	return f.periodStart + abi.ChainEpoch(periods)*miner16.WPoStProvingPeriod + abi.ChainEpoch(dl+1)*miner16.WPoStChallengeWindow - 1
+}
+
+func newMemFixture(t *testing.T, nv network.Version, vesting []miner16.VestingFund) *memFixture {
+	t.Helper()
+	chain, err := newMemChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.networkVersion = nv
+	mid, _ := address.NewIDAddress(1155)
+	owner, _ := address.NewIDAddress(1156)
+	f := &memFixture{chain: chain, mid: mid, periodStart: memHeight - memHeight%miner16.WPoStProvingPeriod}
+
+	// 每个高度 0.001 FIL 奖励，全网 32 TiB，32GiB 扇区的 fault fee 是 10108 * 0.001 / 1024 = 0.00987109375 FIL
+	rewardPerEpoch, networkPower := memFIL(1), big.Lsh(big.NewInt(1), 45)
+	if err := chain.setSmoothing(rewardPerEpoch, networkPower); err != nil {
+		t.Fatal(err)
+	}
+	f.reward = smoothing.NewEstimate(rewardPerEpoch, big.Zero())
+	f.power = smoothing.NewEstimate(networkPower, big.Zero())
+
+	commR, err := abi.CidBuilder.Sum([]byte("commr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个扇区的日奖励 0.01 FIL，20 天奖励 0.2 FIL
+	sector := func(num abi.SectorNumber, dl uint64, activation, powerBase, expiration abi.ChainEpoch, pledge, replaced int64, dailyFee abi.TokenAmount) memSector {
+		dayReward, storagePledge, replacedReward := memFIL(10), memFIL(200), memFIL(replaced)
+		return memSector{SectorOnChainInfo: miner16.SectorOnChainInfo{
+			SectorNumber:          num,
+			SealProof:             abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+			SealedCID:             commR,
+			Activation:            activation,
+			Expiration:            expiration,
+			DealWeight:            big.Zero(),
+			VerifiedDealWeight:    big.Zero(),
+			InitialPledge:         memFIL(pledge),
+			ExpectedDayReward:     &dayReward,
+			ExpectedStoragePledge: &storagePledge,
+			PowerBaseEpoch:        powerBase,
+			ReplacedDayReward:     &replacedReward,
+			DailyFee:              dailyFee,
+		}, Deadline: dl}
+	}
+	epd := netProfile.epochsPerDay()
+	f.sectors = []memSector{
+		sector(1, 0, memHeight-100*epd, memHeight-100*epd, f.expiration(0, 10), 5000, 0, memFIL(1)),
+		// 10 天前续期
+		sector(2, 1, memHeight-30*epd, memHeight-10*epd, f.expiration(1, 10), 5000, 5, memFIL(2)),
+		// FIP-100 之前的扇区没有日费
+		sector(3, 0, memHeight-200*epd, memHeight-200*epd, f.expiration(0, 20), 4000, 0, abi.TokenAmount{}),
+		// 质押很小，FIP-0098 罚金是 105% fault fee
+		sector(4, 2, memHeight-100*epd, memHeight-100*epd, f.expiration(2, 15), 100, 0, abi.TokenAmount{}),
+	}
+	f.sectors[2].Faulty = true
+	if err := chain.putMiner(mid, owner, f.periodStart, f.sectors, vesting); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chain.addTipSet(dayStartHeight(memHeight)); err != nil {
+		t.Fatal(err)
+	}
+	if f.ts, err = chain.addTipSet(memHeight); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// getJSON 请求 handler 并解码 APIResponse，data 解码到 out
+func getJSON(t *testing.T, h gin.HandlerFunc, target string, out interface{}) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/*path", h)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", target, w.Code, w.Body)
+	}
+	resp := APIResponse{Data: out}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+}
+
+func TestMemChainSmoothing(t *testing.T) {
+	f := newMemFixture(t, network.Version25, nil)
+	reward, power, err := calc.GetSmoothing(context.Background(), f.chain, f.ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reward.PositionEstimate.Equals(f.reward.PositionEstimate) || !power.PositionEstimate.Equals(f.power.PositionEstimate) {
+		t.Fatalf("smoothing = %v %v, want %v %v", reward, power, f.reward, f.power)
+	}
+}
+
+func TestPenaltyHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		nv   network.Version
+		// 按扇区号排列的罚金，单位 attoFIL
+		penalties []string
+	}{
+		// 0.2 FIL 加上 min(扇区年龄, 140 天) 的一半日奖励，续期前的年龄用续期前的日奖励补足
+		{"legacy", network.Version24, []string{
+			"700000000000000000", // 0.2 + 0.01*100/2
+			"300000000000000000", // 0.2 + (0.01*10 + 0.005*20)/2
+			"900000000000000000", // 0.2 + 0.01*140/2
+			"700000000000000000", // 0.2 + 0.01*100/2
+		}},
+		// 8.5% 质押 * min(年龄, 140 天)/140，不低于 2% 质押和 105% fault fee，年龄从激活算起
+		{"fip0098", network.Version25, []string{
+			"303571428571428571", // 5 * 8.5% * 100/140
+			"100000000000000000", // 5 * 2%，大于 5 * 8.5% * 30/140
+			"340000000000000000", // 4 * 8.5%
+			"10364648437500000",  // 0.00987109375 * 105%
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newMemFixture(t, tt.nv, nil)
+
+			type day struct {
+				sectors         int
+				pledge, penalty abi.TokenAmount
+			}
+			want := make(map[string]*day)
+			for i, s := range f.sectors {
+				penalty, err := big.FromString(tt.penalties[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				date := heightToTime(int64(s.Expiration))
+				d, ok := want[date]
+				if !ok {
+					d = &day{pledge: big.Zero(), penalty: big.Zero()}
+					want[date] = d
+				}
+				d.sectors++
+				d.pledge = big.Add(d.pledge, s.InitialPledge)
+				d.penalty = big.Add(d.penalty, penalty)
+			}
+
+			var rows []*penaltyDay
+			getJSON(t, penalty(f.chain), "/penalty?format=json&miner="+f.mid.String(), &rows)
+			if len(rows) != len(want) {
+				t.Fatalf("got %d rows, want %d", len(rows), len(want))
+			}
+			for _, r := range rows {
+				d, ok := want[r.Date]
+				if !ok {
+					t.Fatalf("unexpected date %s", r.Date)
+				}
+				if r.Sectors_sum != d.sectors || r.Pledge != toFIL(d.pledge) || r.Penalty != toFIL(d.penalty) {
+					t.Fatalf("%s: got %d sectors, pledge %s, penalty %s; want %d, %s, %s",
+						r.Date, r.Sectors_sum, r.Pledge, r.Penalty, d.sectors, toFIL(d.pledge), toFIL(d.penalty))
+				}
+			}
+		})
+	}
+}
+
+func TestPenaltyCurveHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		nv    network.Version
+		first string // 第一天的罚金，即 TestPenaltyHandler 中四个扇区之和
+	}{
+		{"legacy", network.Version24, "2600000000000000000"},
+		{"fip0098", network.Version25, "753936077008928571"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newMemFixture(t, tt.nv, nil)
+			var curve penaltyCurve
+			getJSON(t, penaltyCurveHandler(f.chain), "/penalty/curve?format=json&miner="+f.mid.String(), &curve)
+			if len(curve.Buckets) != 3 {
+				t.Fatalf("got %d buckets, want 3", len(curve.Buckets))
+			}
+			first, err := big.FromString(tt.first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(curve.Days) == 0 || curve.Days[0].Penalty != toFIL(first) {
+				t.Fatalf("first day penalty: got %+v, want %s", curve.Days, toFIL(first))
+			}
+
+			// 每天都与逐个扇区调用 Fee 的结果一致
+			ms, err := calc.LoadMinerSectors(context.Background(), f.chain, f.ts, f.mid, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy := calc.TerminationPolicyFor(tt.nv)
+			for j, p := range curve.Days {
+				height := memHeight + abi.ChainEpoch(j)*netProfile.epochsPerDay()
+				total := big.Zero()
+				for _, info := range ms.Sectors {
+					if ms.QuantizedExpiration(info) <= height {
+						continue
+					}
+					ff := calc.FaultFeeForPower(miner16.QAPowerForSector(ms.Info.SectorSize, info), f.reward, f.power)
+					fee, _ := policy.Fee(height, info, ff)
+					total = big.Add(total, fee)
+				}
+				if p.Penalty != toFIL(total) {
+					t.Fatalf("day %d (%s): got %s, want %s", j, p.Date, p.Penalty, toFIL(total))
+				}
+			}
+		})
+	}
+}
+
+func TestVestedHandler(t *testing.T) {
+	epd := netProfile.epochsPerDay()
+	start := dayStartHeight(memHeight)
+	f := newMemFixture(t, network.Version25, []miner16.VestingFund{
+		{Epoch: start + 100, Amount: memFIL(2000)},
+		// 恰好在第二天开始时释放，计入第二天
+		{Epoch: start + epd, Amount: memFIL(3000)},
+		{Epoch: start + 3*epd - 1, Amount: memFIL(4000)},
+	})
+
+	var rows []*vestedDay
+	getJSON(t, vestedFunds(f.chain), "/vested?format=json&miner="+f.mid.String(), &rows)
+	want := []*vestedDay{
+		{Date: heightToTime(int64(start + epd - 1)), VestedFunds: toFIL(memFIL(2000)), Miner: f.mid.String()},
+		{Date: heightToTime(int64(start + 2*epd - 1)), VestedFunds: toFIL(memFIL(3000)), Miner: f.mid.String()},
+		{Date: heightToTime(int64(start + 3*epd - 1)), VestedFunds: toFIL(memFIL(4000)), Miner: f.mid.String()},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if *rows[i] != *want[i] {
+			t.Fatalf("row %d = %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestExtendHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		nv   network.Version
+		// 扇区 3、4 延期后新增的日费
+		added string
+	}{
+		// 5.56e-15 * 10 亿 FIL，每个 32GiB 扇区约 0.00000556 FIL
+		{"fip100", network.Version25, "11119979566988"},
+		{"before-fip100", network.Version24, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newMemFixture(t, tt.nv, nil)
+			f.chain.circulatingSupply.FilCirculating = big.Mul(big.NewInt(1e9), memFIL(1000))
+			target := "/extend?format=json&sectors=3,4&miner=" + f.mid.String() + "&expiration=" + heightToTime(int64(memHeight+400*netProfile.epochsPerDay()))
+
+			worker, _ := address.NewIDAddress(1156)
+			var plan extendPlan
+			getJSON(t, sectorsExtend(f.chain), target, &plan)
+			if len(plan.Sectors) != 2 || len(plan.Rejected) != 0 {
+				t.Fatalf("got %d sectors and %d rejected, want 2 and 0", len(plan.Sectors), len(plan.Rejected))
+			}
+			if got := plan.AddedDailyFee.Atto.String(); got != tt.added {
+				t.Fatalf("added daily fee = %s, want %s", got, tt.added)
+			}
+			if !plan.PledgeDelta.Atto.IsZero() || len(plan.Batches) != 1 || plan.Batches[0].Message.From != worker {
+				t.Fatalf("got pledge delta %s and batches %+v", plan.PledgeDelta.Atto, plan.Batches)
+			}
+
+			// sender 无效时是参数错误
+			w := httptest.NewRecorder()
+			r := gin.New()
+			r.GET("/*path", sectorsExtend(f.chain))
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target+"&sender=bad", nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("bad sender: got %d %s, want 400", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestFeePayments(t *testing.T) {
+	f := newMemFixture(t, network.Version25, nil)
+	ms, err := calc.LoadMinerSectors(context.Background(), f.chain, f.ts, f.mid, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dl 0 在 memHeight 之后的第一次扣费
+	first := f.expiration(0, 1)
+	tests := []struct {
+		name       string
+		dl         uint64
+		expiration abi.ChainEpoch
+		want       int64
+	}{
+		{"ten-periods", 0, f.expiration(0, 10), 9},
+		{"expires-at-first", 0, first, 0},
+		{"expired", 0, memHeight - 1, 0},
+		{"just-after-first", 0, first + 1, 1},
+		// dl 47 在当前周期还没有结束
+		{"last-deadline", 47, f.expiration(47, 1), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ms.FeePayments(tt.dl, tt.expiration, memHeight); got != tt.want {
+				t.Fatalf("FeePayments = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeeOutflow(t *testing.T) {
+	f := newMemFixture(t, network.Version25, nil)
+	ctx := context.Background()
+	ms, err := calc.LoadMinerSectors(ctx, f.chain, f.ts, f.mid, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fee, err := calc.MinerDailyFee(ctx, f.chain, f.ts, f.mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 扇区 1、2 各扣 9 次，扇区 3 没有日费
+	if want := memFIL(3); !fee.DailyFee.Equals(want) {
+		t.Fatalf("daily fee = %s, want %s", fee.DailyFee, want)
+	}
+	if want := memFIL(27); !fee.TotalFee.Equals(want) {
+		t.Fatalf("total fee = %s, want %s", fee.TotalFee, want)
+	}
+
+	days := ms.FeeOutflow(memHeight, func(epoch abi.ChainEpoch) string { return heightToTime(int64(epoch)) })
+	total, payments := big.Zero(), 0
+	for i, d := range days {
+		if i > 0 && d.Day <= days[i-1].Day {
+			t.Fatalf("days out of order: %s after %s", d.Day, days[i-1].Day)
+		}
+		total = big.Add(total, d.Fee)
+		payments += d.Sectors
+	}
+	if !total.Equals(fee.TotalFee) || payments != 18 {
+		t.Fatalf("outflow = %s in %d payments, want %s in 18", total, payments, fee.TotalFee)
+	}
+}
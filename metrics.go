@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	apitypes "github.com/filecoin-project/lotus/api/types"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "sectors_penalty"
+
+// 金额单位为 FIL
+var (
+	minerLiveSectors = newMinerGauge("miner_live_sectors", "Live sectors of the miner")
+	minerPledge      = newMinerGauge("miner_pledge_fil", "Initial pledge of the live sectors")
+	minerTermPenalty = newMinerGauge("miner_termination_penalty_fil", "Termination penalty of all live sectors at the head")
+	minerVesting     = newMinerGauge("miner_vesting_funds_fil", "Locked funds still vesting")
+	minerDailyFee    = newMinerGauge("miner_daily_fee_fil", "Current FIP-100 daily fee from StateMinerDeadlines")
+	minerTotalFee    = newMinerGauge("miner_projected_total_fee_fil", "Projected daily fee until every live sector expires")
+	minerHeight      = newMinerGauge("miner_metrics_height", "Height the miner metrics were computed at")
+
+	minerVestingNext = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "miner_vesting_next_fil",
+		Help:      "Funds vesting within the next N days",
+	}, []string{"miner", "days"})
+	minerPledgeExpiring = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "miner_pledge_expiring_fil",
+		Help:      "Initial pledge of sectors expiring within the next N days",
+	}, []string{"miner", "days"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests per route",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"route", "code"})
+	lotusDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lotus_request_duration_seconds",
+		Help:      "Latency of lotus API calls per method",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"method"})
+	lotusErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lotus_request_errors_total",
+		Help:      "Failed lotus API calls per method",
+	}, []string{"method"})
+)
+
+// 统计释放和到期质押的天数
+var metricsDays = []int{1, 7, 30}
+
+func newMinerGauge(name, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+	}, []string{"miner"})
+}
+
+var minerGauges = []*prometheus.GaugeVec{minerLiveSectors, minerPledge, minerTermPenalty, minerVesting, minerDailyFee, minerTotalFee, minerHeight, minerVestingNext, minerPledgeExpiring}
+
+func init() {
+	for _, g := range minerGauges {
+		prometheus.MustRegister(g)
+	}
+	prometheus.MustRegister(httpDuration, lotusDuration, lotusErrors)
+}
+
+// metricsHandler 是 /metrics
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// httpMetrics 记录每个路由的耗时
+func httpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// minerMetrics 是矿工在某个高度的指标
+type minerMetrics struct {
+	mid      address.Address
+	height   abi.ChainEpoch
+	sectors  int
+	pledge   abi.TokenAmount
+	penalty  abi.TokenAmount
+	vesting  abi.TokenAmount
+	dailyFee abi.TokenAmount
+	totalFee abi.TokenAmount
+	// 未来 N 天释放的锁仓和到期扇区的质押
+	vestNext map[int]abi.TokenAmount
+	expiring map[int]abi.TokenAmount
+}
+
+// computeMinerMetrics 计算矿工在 ts 上的指标
+func computeMinerMetrics(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address) (*minerMetrics, error) {
+	rows, _, err := calc.SectorPenalties(ctx, lapi, ts, mid, calc.PenaltyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	vested, err := calc.VestingSchedule(ctx, lapi, ts, mid, dayStartHeight(ts.Height()), netProfile.epochsPerDay())
+	if err != nil {
+		return nil, err
+	}
+	fee, err := calc.MinerDailyFee(ctx, lapi, ts, mid)
+	if err != nil {
+		return nil, err
+	}
+
+	mm := &minerMetrics{
+		mid:      mid,
+		height:   ts.Height(),
+		sectors:  len(rows),
+		pledge:   big.Zero(),
+		penalty:  big.Zero(),
+		vesting:  big.Zero(),
+		dailyFee: fee.DailyFee,
+		totalFee: fee.TotalFee,
+		vestNext: make(map[int]abi.TokenAmount),
+		expiring: make(map[int]abi.TokenAmount),
+	}
+	for _, days := range metricsDays {
+		mm.vestNext[days] = big.Zero()
+		mm.expiring[days] = big.Zero()
+	}
+	for _, r := range rows {
+		mm.pledge = big.Add(mm.pledge, r.InitialPledge)
+		mm.penalty = big.Add(mm.penalty, r.Penalty)
+		for _, days := range metricsDays {
+			if r.QuantizedExpiration <= ts.Height()+abi.ChainEpoch(days)*netProfile.epochsPerDay() {
+				mm.expiring[days] = big.Add(mm.expiring[days], r.InitialPledge)
+			}
+		}
+	}
+	for _, d := range vested {
+		mm.vesting = big.Add(mm.vesting, d.Vested)
+		for _, days := range metricsDays {
+			if d.End <= ts.Height()+abi.ChainEpoch(days)*netProfile.epochsPerDay() {
+				mm.vestNext[days] = big.Add(mm.vestNext[days], d.Vested)
+			}
+		}
+	}
+	return mm, nil
+}
+
+func (mm *minerMetrics) set() {
+	m := mm.mid.String()
+	minerLiveSectors.WithLabelValues(m).Set(float64(mm.sectors))
+	minerPledge.WithLabelValues(m).Set(calc.AttoToFIL(mm.pledge))
+	minerTermPenalty.WithLabelValues(m).Set(calc.AttoToFIL(mm.penalty))
+	minerVesting.WithLabelValues(m).Set(calc.AttoToFIL(mm.vesting))
+	minerDailyFee.WithLabelValues(m).Set(calc.AttoToFIL(mm.dailyFee))
+	minerTotalFee.WithLabelValues(m).Set(calc.AttoToFIL(mm.totalFee))
+	minerHeight.WithLabelValues(m).Set(float64(mm.height))
+	for _, days := range metricsDays {
+		d := strconv.Itoa(days)
+		minerVestingNext.WithLabelValues(m, d).Set(calc.AttoToFIL(mm.vestNext[days]))
+		minerPledgeExpiring.WithLabelValues(m, d).Set(calc.AttoToFIL(mm.expiring[days]))
+	}
+}
+
+// watchMetrics 链头变化时重新计算 watch 中矿工的指标，直到 ctx 结束
+func watchMetrics(ctx context.Context, lapi ChainReader, watch *minerQuery) {
+	ticker := time.NewTicker(time.Duration(netProfile.BlockDelay) * time.Second)
+	defer ticker.Stop()
+	var head types.TipSetKey
+	for {
+		ts, err := lapi.ChainHead(ctx)
+		if err != nil {
+			log.Printf("metrics: %v\n", err)
+		} else if ts.Key() != head {
+			if err := updateMinerMetrics(ctx, lapi, ts, watch); err != nil {
+				log.Printf("metrics: %v\n", err)
+			} else {
+				head = ts.Key()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func updateMinerMetrics(ctx context.Context, lapi ChainReader, ts *types.TipSet, watch *minerQuery) error {
+	mids, err := watch.resolve(ctx, lapi, ts)
+	if err != nil {
+		return err
+	}
+	all, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) (*minerMetrics, error) {
+		return computeMinerMetrics(ctx, lapi, ts, mid)
+	})
+	if err != nil {
+		return err
+	}
+	// owner 名下的矿工可能变化，先清掉旧的
+	for _, g := range minerGauges {
+		g.Reset()
+	}
+	for _, mm := range all {
+		mm.set()
+	}
+	return nil
+}
+
+// meteredChain 记录每个 lotus 接口的耗时和错误数
+type meteredChain struct {
+	ChainReader
+}
+
+func observe(method string, start time.Time, err error) {
+	lotusDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		lotusErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (m meteredChain) ChainReadObj(ctx context.Context, c cid.Cid) (b []byte, err error) {
+	defer func(start time.Time) { observe("ChainReadObj", start, err) }(time.Now())
+	return m.ChainReader.ChainReadObj(ctx, c)
+}
+
+func (m meteredChain) ChainHasObj(ctx context.Context, c cid.Cid) (ok bool, err error) {
+	defer func(start time.Time) { observe("ChainHasObj", start, err) }(time.Now())
+	return m.ChainReader.ChainHasObj(ctx, c)
+}
+
+func (m meteredChain) ChainPutObj(ctx context.Context, blk blocks.Block) (err error) {
+	defer func(start time.Time) { observe("ChainPutObj", start, err) }(time.Now())
+	return m.ChainReader.ChainPutObj(ctx, blk)
+}
+
+func (m meteredChain) ChainHead(ctx context.Context) (ts *types.TipSet, err error) {
+	defer func(start time.Time) { observe("ChainHead", start, err) }(time.Now())
+	return m.ChainReader.ChainHead(ctx)
+}
+
+func (m meteredChain) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (ts *types.TipSet, err error) {
+	defer func(start time.Time) { observe("ChainGetTipSet", start, err) }(time.Now())
+	return m.ChainReader.ChainGetTipSet(ctx, tsk)
+}
+
+func (m meteredChain) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (ts *types.TipSet, err error) {
+	defer func(start time.Time) { observe("ChainGetTipSetByHeight", start, err) }(time.Now())
+	return m.ChainReader.ChainGetTipSetByHeight(ctx, h, tsk)
+}
+
+func (m meteredChain) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (nv apitypes.NetworkVersion, err error) {
+	defer func(start time.Time) { observe("StateNetworkVersion", start, err) }(time.Now())
+	return m.ChainReader.StateNetworkVersion(ctx, tsk)
+}
+
+func (m meteredChain) StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (act *types.Actor, err error) {
+	defer func(start time.Time) { observe("StateGetActor", start, err) }(time.Now())
+	return m.ChainReader.StateGetActor(ctx, actor, tsk)
+}
+
+func (m meteredChain) StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (info api.MinerInfo, err error) {
+	defer func(start time.Time) { observe("StateMinerInfo", start, err) }(time.Now())
+	return m.ChainReader.StateMinerInfo(ctx, actor, tsk)
+}
+
+func (m meteredChain) StateMinerProvingDeadline(ctx context.Context, actor address.Address, tsk types.TipSetKey) (di *dline.Info, err error) {
+	defer func(start time.Time) { observe("StateMinerProvingDeadline", start, err) }(time.Now())
+	return m.ChainReader.StateMinerProvingDeadline(ctx, actor, tsk)
+}
+
+func (m meteredChain) StateMinerPartitions(ctx context.Context, actor address.Address, dlIdx uint64, tsk types.TipSetKey) (parts []api.Partition, err error) {
+	defer func(start time.Time) { observe("StateMinerPartitions", start, err) }(time.Now())
+	return m.ChainReader.StateMinerPartitions(ctx, actor, dlIdx, tsk)
+}
+
+func (m meteredChain) StateMinerSectors(ctx context.Context, actor address.Address, sectorNos *bitfield.BitField, tsk types.TipSetKey) (infos []*miner.SectorOnChainInfo, err error) {
+	defer func(start time.Time) { observe("StateMinerSectors", start, err) }(time.Now())
+	return m.ChainReader.StateMinerSectors(ctx, actor, sectorNos, tsk)
+}
+
+func (m meteredChain) StateMinerDeadlines(ctx context.Context, actor address.Address, tsk types.TipSetKey) (dls []api.Deadline, err error) {
+	defer func(start time.Time) { observe("StateMinerDeadlines", start, err) }(time.Now())
+	return m.ChainReader.StateMinerDeadlines(ctx, actor, tsk)
+}
+
+func (m meteredChain) StateVMCirculatingSupplyInternal(ctx context.Context, tsk types.TipSetKey) (cs api.CirculatingSupply, err error) {
+	defer func(start time.Time) { observe("StateVMCirculatingSupplyInternal", start, err) }(time.Now())
+	return m.ChainReader.StateVMCirculatingSupplyInternal(ctx, tsk)
+}
+
+// ChainNotify 只在被包装的节点支持时可用，见 headChanges
+func (m meteredChain) ChainNotify(ctx context.Context) (ch <-chan []*api.HeadChange, err error) {
+	defer func(start time.Time) { observe("ChainNotify", start, err) }(time.Now())
+	n, ok := m.ChainReader.(chainNotifier)
+	if !ok {
+		return nil, fmt.Errorf("ChainNotify is not supported in offline mode")
+	}
+	return n.ChainNotify(ctx)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+)
+
+// minerQuery 是 miner=（逗号分隔的矿工）和 owner=（逗号分隔的 owner 或 worker 地址）参数
+type minerQuery struct {
+	miners []address.Address
+	owners []address.Address
+}
+
+// parseMinerQuery 解析 miner= 和 owner= 参数，multi 为 false 的接口只接受一个矿工
+func parseMinerQuery(miners, owners string, multi bool) (*minerQuery, error) {
+	q := &minerQuery{}
+	var err error
+	if q.miners, err = parseAddressList(miners); err != nil {
+		return nil, err
+	}
+	if q.owners, err = parseAddressList(owners); err != nil {
+		return nil, err
+	}
+	if len(q.miners) == 0 && len(q.owners) == 0 {
+		return nil, fmt.Errorf("please specify a miner")
+	}
+	if !multi && (len(q.miners) != 1 || len(q.owners) != 0) {
+		return nil, fmt.Errorf("only one miner is supported here")
+	}
+	return q, nil
+}
+
+func parseAddressList(s string) ([]address.Address, error) {
+	var addrs []address.Address
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		addr, err := address.NewFromString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", v, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// many 是否按多个矿工输出，指定了 owner 时总是按多个矿工输出
+func (q *minerQuery) many() bool {
+	return len(q.owners) > 0 || len(q.miners) > 1
+}
+
+// resolve 返回 ts 时的全部矿工，owner 展开为其名下的矿工，结果去重
+func (q *minerQuery) resolve(ctx context.Context, lapi ChainReader, ts *types.TipSet) ([]address.Address, error) {
+	mids := append([]address.Address{}, q.miners...)
+	for _, owner := range q.owners {
+		owned, err := calc.MinersOf(ctx, lapi, ts, owner)
+		if err != nil {
+			return nil, err
+		}
+		mids = append(mids, owned...)
+	}
+	seen := make(map[address.Address]bool, len(mids))
+	out := mids[:0]
+	for _, mid := range mids {
+		if !seen[mid] {
+			seen[mid] = true
+			out = append(out, mid)
+		}
+	}
+	return out, nil
+}
+
+// minerQueryOrAbort 解析失败时直接返回 400
+func minerQueryOrAbort(c *gin.Context, multi bool) (*minerQuery, bool) {
+	q, err := parseMinerQuery(c.Query("miner"), c.Query("owner"), multi)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Code: http.StatusBadRequest,
+			Msg:  err.Error(),
+		})
+		return nil, false
+	}
+	return q, true
+}
+
+// resolveOrAbort 展开 owner 失败时直接返回 500
+func resolveOrAbort(lapi ChainReader, c *gin.Context, q *minerQuery, ts *types.TipSet) ([]address.Address, bool) {
+	mids, err := q.resolve(c.Request.Context(), lapi, ts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Code: http.StatusInternalServerError,
+			Msg:  err.Error(),
+		})
+		return nil, false
+	}
+	return mids, true
+}
+
+// minerPenalty 是多个矿工时每个矿工的 /penalty 结果
+type minerPenalty struct {
+	Miner string        `json:"miner"`
+	Days  []*penaltyDay `json:"days"`
+}
+
+// computeMiners 并发计算多个矿工的 /penalty，并把过期日历按日期合并，合并行的 mid 为 all
+func computeMiners(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mids []address.Address, allSectors bool, offset abi.ChainEpoch, proj calc.Projection, fees bool) (*result, error) {
+	calendars, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) ([]*calc.ExpirationDay, error) {
+		return expirationDays(ctx, lapi, tsk, mid, allSectors, offset, proj)
+	})
+	if err != nil {
+		return nil, err
+	}
+	combined := calc.MergeExpirationDays(calendars...)
+
+	// fees 为 false 时 outflows 为空，combinedOutflow 为 nil
+	outflows := make([][]*calc.FeeDay, len(mids))
+	var combinedOutflow []*calc.FeeDay
+	if fees {
+		outflows, err = calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) ([]*calc.FeeDay, error) {
+			return feeOutflow(ctx, lapi, tsk, mid, allSectors, offset)
+		})
+		if err != nil {
+			return nil, err
+		}
+		combinedOutflow = calc.MergeFeeDays(outflows...)
+	}
+	penaltyDays := func(mid string, days []*calc.ExpirationDay, outflow []*calc.FeeDay) []*penaltyDay {
+		if fees {
+			return newFeePenaltyDays(mid, days, outflow)
+		}
+		return newPenaltyDays(mid, days)
+	}
+
+	perMiner := make([]*minerPenalty, len(mids))
+	var rows []*penaltyDay
+	for i, mid := range mids {
+		perMiner[i] = &minerPenalty{Miner: mid.String(), Days: penaltyDays(mid.String(), calendars[i], outflows[i])}
+		rows = append(rows, perMiner[i].Days...)
+	}
+	all := penaltyDays("all", combined, combinedOutflow)
+	rows = append(rows, all...)
+	return &result{
+		data: struct {
+			Miners   []*minerPenalty `json:"miners"`
+			Combined []*penaltyDay   `json:"combined"`
+		}{perMiner, all},
+		records: rows,
+		table:   penaltyTable(rows, combined, combinedOutflow),
+	}, nil
+}
+
+// getVestedMiners 并发计算多个矿工的释放计划，并按日期合并，合并行的 Miner 为 all
+func getVestedMiners(ctx context.Context, lapi ChainReader, ts *types.TipSet, startEpoch abi.ChainEpoch, mids []address.Address) (*result, error) {
+	schedules, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) ([]calc.VestedDay, error) {
+		return calc.VestingSchedule(ctx, lapi, ts, mid, startEpoch, netProfile.epochsPerDay())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type minerVested struct {
+		Miner string       `json:"miner"`
+		Days  []*vestedDay `json:"days"`
+	}
+	perMiner := make([]*minerVested, len(mids))
+	var rows []*vestedDay
+	for i, mid := range mids {
+		perMiner[i] = &minerVested{Miner: mid.String(), Days: newVestedDays(mid.String(), schedules[i])}
+		rows = append(rows, perMiner[i].Days...)
+	}
+	all := newVestedDays("all", calc.MergeVestingSchedules(schedules...))
+	rows = append(rows, all...)
+	return &result{
+		data: struct {
+			Miners   []*minerVested `json:"miners"`
+			Combined []*vestedDay   `json:"combined"`
+		}{perMiner, all},
+		records: rows,
+		table:   vestedTable(rows),
+	}, nil
+}
+
+// computeSpDailyFeeMiners 并发计算多个矿工的日费，并汇总，汇总行的 miner 为 all
+func computeSpDailyFeeMiners(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mids []address.Address) (*result, error) {
+	fees, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) (*calc.MinerFee, error) {
+		return calc.MinerDailyFee(ctx, lapi, tsk, mid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := struct {
+		Miners   []minerFee `json:"miners"`
+		DailyFee filAmount  `json:"daily_fee"`
+		TotalFee filAmount  `json:"total_fee"`
+	}{Miners: make([]minerFee, len(mids))}
+	all := &calc.MinerFee{DailyFee: big.Zero(), TotalFee: big.Zero()}
+	for i, mid := range mids {
+		out.Miners[i] = newMinerFee(mid.String(), fees[i])
+		all.DailyFee = big.Add(all.DailyFee, fees[i].DailyFee)
+		all.TotalFee = big.Add(all.TotalFee, fees[i].TotalFee)
+		all.Sectors += fees[i].Sectors
+	}
+	combined := newMinerFee("all", all)
+	out.DailyFee, out.TotalFee = combined.DailyFee, combined.TotalFee
+	rows := append(out.Miners, combined)
+	return &result{data: out, records: rows, table: minerFeeTable(tsk, rows)}, nil
+}
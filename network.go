@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api/v0api"
+	"github.com/filecoin-project/lotus/build/buildconstants"
+	"github.com/filecoin-project/lotus/chain/consensus/filcns"
+)
+
+// networkUpgrade 是一次网络升级，升级在 Height 之后的第一个高度生效
+type networkUpgrade struct {
+	Height  abi.ChainEpoch  `json:"height"`
+	Network network.Version `json:"network"`
+}
+
+// networkProfile 描述一个网络的创世时间、出块间隔和升级高度
+type networkProfile struct {
+	Name           string           `json:"name"`
+	GenesisTime    int64            `json:"genesis_time"`
+	BlockDelay     int64            `json:"block_delay"`
+	LotusAPI       string           `json:"lotus_api"`
+	GenesisNetwork network.Version  `json:"genesis_network"`
+	Upgrades       []networkUpgrade `json:"upgrades"`
+}
+
+// netProfile 是当前使用的网络，默认主网
+var netProfile = mainnetProfile()
+
+func mainnetProfile() *networkProfile {
+	p := &networkProfile{
+		Name:           "mainnet",
+		GenesisTime:    1598306400,
+		BlockDelay:     30,
+		LotusAPI:       LotusApi,
+		GenesisNetwork: buildconstants.GenesisNetworkVersion,
+	}
+	// 本程序按主网编译，直接使用 lotus 的升级计划
+	for _, u := range filcns.DefaultUpgradeSchedule() {
+		p.Upgrades = append(p.Upgrades, networkUpgrade{Height: u.Height, Network: u.Network})
+	}
+	return p
+}
+
+// https://github.com/filecoin-project/lotus/blob/v1.32.2/build/buildconstants/params_calibnet.go
+func calibnetProfile() *networkProfile {
+	return &networkProfile{
+		Name:           "calibnet",
+		GenesisTime:    1667326380,
+		BlockDelay:     30,
+		LotusAPI:       "https://api.calibration.node.glif.io",
+		GenesisNetwork: network.Version0,
+		Upgrades: []networkUpgrade{
+			{30, network.Version4},
+			{60, network.Version5},
+			{90, network.Version6},
+			{120, network.Version7},
+			{240, network.Version8},
+			{300, network.Version9},
+			{330, network.Version10},
+			{360, network.Version11},
+			{390, network.Version12},
+			{420, network.Version13},
+			{450, network.Version14},
+			{480, network.Version15},
+			{510, network.Version16},
+			{16800, network.Version17},
+			{322354, network.Version18},
+			{489094, network.Version19},
+			{492214, network.Version20},
+			{1013134, network.Version21},
+			{1427974, network.Version22},
+			{1779094, network.Version23},
+			{2078794, network.Version24},
+			{2523454, network.Version25},
+			{2543614, network.Version26},
+		},
+	}
+}
+
+// loadNetworkFile 读取自定义网络的 JSON 配置
+func loadNetworkFile(path string) (*networkProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &networkProfile{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if p.GenesisTime <= 0 || p.BlockDelay <= 0 {
+		return nil, fmt.Errorf("%s: genesis_time and block_delay are required", path)
+	}
+	return p, nil
+}
+
+// deriveNetwork 从节点的创世块和 StateGetNetworkParams 生成网络配置
+func deriveNetwork(ctx context.Context, full v0api.FullNode) (*networkProfile, error) {
+	params, err := full.StateGetNetworkParams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := full.ChainGetGenesis(ctx)
+	if err != nil {
+		return nil, err
+	}
+	genesisNetwork, err := full.StateNetworkVersion(ctx, genesis.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	f := params.ForkUpgradeParams
+	p := &networkProfile{
+		Name:           string(params.NetworkName),
+		GenesisTime:    int64(params.GenesisTimestamp),
+		BlockDelay:     int64(params.BlockDelaySecs),
+		GenesisNetwork: genesisNetwork,
+		Upgrades: []networkUpgrade{
+			{f.UpgradeBreezeHeight, network.Version1},
+			{f.UpgradeSmokeHeight, network.Version2},
+			{f.UpgradeIgnitionHeight, network.Version3},
+			{f.UpgradeRefuelHeight, network.Version3},
+			{f.UpgradeAssemblyHeight, network.Version4},
+			{f.UpgradeTapeHeight, network.Version5},
+			{f.UpgradeLiftoffHeight, network.Version5},
+			{f.UpgradeKumquatHeight, network.Version6},
+			{f.UpgradeCalicoHeight, network.Version7},
+			{f.UpgradePersianHeight, network.Version8},
+			{f.UpgradeOrangeHeight, network.Version9},
+			{f.UpgradeTrustHeight, network.Version10},
+			{f.UpgradeNorwegianHeight, network.Version11},
+			{f.UpgradeTurboHeight, network.Version12},
+			{f.UpgradeHyperdriveHeight, network.Version13},
+			{f.UpgradeChocolateHeight, network.Version14},
+			{f.UpgradeOhSnapHeight, network.Version15},
+			{f.UpgradeSkyrHeight, network.Version16},
+			{f.UpgradeSharkHeight, network.Version17},
+			{f.UpgradeHyggeHeight, network.Version18},
+			{f.UpgradeLightningHeight, network.Version19},
+			{f.UpgradeThunderHeight, network.Version20},
+			{f.UpgradeWatermelonHeight, network.Version21},
+			{f.UpgradeDragonHeight, network.Version22},
+			{f.UpgradeWaffleHeight, network.Version23},
+			{f.UpgradeTuktukHeight, network.Version24},
+			{f.UpgradeTeepHeight, network.Version25},
+			{f.UpgradeTockHeight, network.Version26},
+		},
+	}
+	sort.Slice(p.Upgrades, func(i, j int) bool { return p.Upgrades[i].Height < p.Upgrades[j].Height })
+	return p, nil
+}
+
+// epochsPerDay 每天的高度数，主网和 calibnet 都是 2880
+func (p *networkProfile) epochsPerDay() abi.ChainEpoch {
+	return abi.ChainEpoch(86400 / p.BlockDelay)
+}
+
+// timeAt 返回高度对应的时间
+func (p *networkProfile) timeAt(height abi.ChainEpoch) time.Time {
+	return time.Unix(p.GenesisTime+int64(height)*p.BlockDelay, 0)
+}
+
+// heightAt 返回时间对应的高度
+func (p *networkProfile) heightAt(t time.Time) abi.ChainEpoch {
+	return abi.ChainEpoch((t.Unix() - p.GenesisTime) / p.BlockDelay)
+}
+
+// networkVersion 与 lotus 的 GetNetworkVersion 一致，高度为负数的升级没有启用
+func (p *networkProfile) networkVersion(height abi.ChainEpoch) network.Version {
+	nv := p.GenesisNetwork
+	for _, u := range p.Upgrades {
+		if u.Height >= 0 && u.Height < height && u.Network > nv {
+			nv = u.Network
+		}
+	}
+	return nv
+}
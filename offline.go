@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/dline"
+	"github.com/filecoin-project/lotus/api"
+	apitypes "github.com/filecoin-project/lotus/api/types"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	carv2 "github.com/ipld/go-car/v2"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// offlineNode 从本地 CAR 快照（如 lotus chain export --recent-stateroots）读取链状态，用于没有 lotus 节点的离线环境
+type offlineNode struct {
+	car  *carbs.ReadOnly
+	bs   blockstore.Blockstore
+	head *types.TipSet
+}
+
+// openSnapshot 打开未压缩的 CAR 文件，tipset 是逗号分隔的区块 cid，作为链头；为空时使用 CAR 的 roots，即 lotus 导出时写入的 tipset
+func openSnapshot(ctx context.Context, path string, tipset string) (*offlineNode, error) {
+	car, err := carbs.OpenReadOnly(path, carv2.ZeroLengthSectionAsEOF(true), carbs.UseWholeCIDs(true))
+	if err != nil {
+		return nil, fmt.Errorf("open car %s: %w", path, err)
+	}
+
+	var cids []cid.Cid
+	if tipset != "" {
+		cids, err = lcli.ParseTipSetString(tipset)
+	} else {
+		cids, err = car.Roots()
+	}
+	if err != nil {
+		_ = car.Close()
+		return nil, err
+	}
+
+	n := &offlineNode{car: car, bs: blockstore.Adapt(car)}
+	n.head, err = n.loadTipSet(ctx, types.NewTipSetKey(cids...))
+	if err != nil {
+		_ = car.Close()
+		return nil, fmt.Errorf("load snapshot tipset: %w", err)
+	}
+	return n, nil
+}
+
+var _ ChainReader = (*offlineNode)(nil)
+
+func (n *offlineNode) Close() error {
+	return n.car.Close()
+}
+
+func (n *offlineNode) loadTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	if tsk.IsEmpty() {
+		return n.head, nil
+	}
+	var blks []*types.BlockHeader
+	for _, c := range tsk.Cids() {
+		blk, err := n.bs.Get(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("block header %s: %w", c, err)
+		}
+		bh, err := types.DecodeBlock(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+		blks = append(blks, bh)
+	}
+	return types.NewTipSet(blks)
+}
+
+func (n *offlineNode) loadMiner(ctx context.Context, addr address.Address, tsk types.TipSetKey) (miner.State, *types.TipSet, error) {
+	ts, err := n.loadTipSet(ctx, tsk)
+	if err != nil {
+		return nil, nil, err
+	}
+	act, err := n.getActor(ctx, addr, ts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load miner actor: %w", err)
+	}
+	mas, err := miner.Load(store.ActorStore(ctx, n.bs), act)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load miner actor state: %w", err)
+	}
+	return mas, ts, nil
+}
+
+func (n *offlineNode) getActor(_ context.Context, addr address.Address, ts *types.TipSet) (*types.Actor, error) {
+	tree, err := state.LoadStateTree(cbor.NewCborStore(n.bs), ts.ParentState())
+	if err != nil {
+		return nil, fmt.Errorf("load state tree: %w", err)
+	}
+	return tree.GetActor(addr)
+}
+
+func (n *offlineNode) ChainHead(context.Context) (*types.TipSet, error) {
+	return n.head, nil
+}
+
+func (n *offlineNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	return n.loadTipSet(ctx, tsk)
+}
+
+// ChainGetTipSetByHeight 从 tsk 往回查找，高于它的高度返回 tsk 本身，快照中没有更新的区块
+func (n *offlineNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, err := n.loadTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+	for ts.Height() > h {
+		ts, err = n.loadTipSet(ctx, ts.Parents())
+		if err != nil {
+			return nil, fmt.Errorf("height %d is not in the snapshot: %w", h, err)
+		}
+	}
+	return ts, nil
+}
+
+func (n *offlineNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	blk, err := n.bs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return blk.RawData(), nil
+}
+
+func (n *offlineNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	return n.bs.Has(ctx, c)
+}
+
+func (n *offlineNode) ChainPutObj(context.Context, blocks.Block) error {
+	return fmt.Errorf("snapshot is read only")
+}
+
+// StateNetworkVersion 按当前网络配置的升级高度推算
+func (n *offlineNode) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (apitypes.NetworkVersion, error) {
+	ts, err := n.loadTipSet(ctx, tsk)
+	if err != nil {
+		return 0, err
+	}
+	return netProfile.networkVersion(ts.Height()), nil
+}
+
+func (n *offlineNode) StateGetActor(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	ts, err := n.loadTipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+	return n.getActor(ctx, addr, ts)
+}
+
+func (n *offlineNode) StateMinerInfo(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	mas, _, err := n.loadMiner(ctx, addr, tsk)
+	if err != nil {
+		return api.MinerInfo{}, err
+	}
+	info, err := mas.Info()
+	if err != nil {
+		return api.MinerInfo{}, err
+	}
+
+	var pid *peer.ID
+	if peerID, err := peer.IDFromBytes(info.PeerId); err == nil {
+		pid = &peerID
+	}
+	ret := api.MinerInfo{
+		Owner:                      info.Owner,
+		Worker:                     info.Worker,
+		ControlAddresses:           info.ControlAddresses,
+		NewWorker:                  address.Undef,
+		WorkerChangeEpoch:          -1,
+		PeerId:                     pid,
+		Multiaddrs:                 info.Multiaddrs,
+		WindowPoStProofType:        info.WindowPoStProofType,
+		SectorSize:                 info.SectorSize,
+		WindowPoStPartitionSectors: info.WindowPoStPartitionSectors,
+		ConsensusFaultElapsed:      info.ConsensusFaultElapsed,
+		PendingOwnerAddress:        info.PendingOwnerAddress,
+		Beneficiary:                info.Beneficiary,
+		BeneficiaryTerm:            &info.BeneficiaryTerm,
+		PendingBeneficiaryTerm:     info.PendingBeneficiaryTerm,
+	}
+	if info.PendingWorkerKey != nil {
+		ret.NewWorker = info.PendingWorkerKey.NewWorker
+		ret.WorkerChangeEpoch = info.PendingWorkerKey.EffectiveAt
+	}
+	return ret, nil
+}
+
+func (n *offlineNode) StateMinerProvingDeadline(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*dline.Info, error) {
+	mas, ts, err := n.loadMiner(ctx, addr, tsk)
+	if err != nil {
+		return nil, err
+	}
+	di, err := mas.DeadlineInfo(ts.Height())
+	if err != nil {
+		return nil, err
+	}
+	return di.NextNotElapsed(), nil
+}
+
+func (n *offlineNode) StateMinerPartitions(ctx context.Context, addr address.Address, dlIdx uint64, tsk types.TipSetKey) ([]api.Partition, error) {
+	mas, _, err := n.loadMiner(ctx, addr, tsk)
+	if err != nil {
+		return nil, err
+	}
+	dl, err := mas.LoadDeadline(dlIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []api.Partition
+	err = dl.ForEachPartition(func(_ uint64, part miner.Partition) error {
+		var p api.Partition
+		for _, f := range []struct {
+			dst *bitfield.BitField
+			get func() (bitfield.BitField, error)
+		}{
+			{&p.AllSectors, part.AllSectors},
+			{&p.FaultySectors, part.FaultySectors},
+			{&p.RecoveringSectors, part.RecoveringSectors},
+			{&p.LiveSectors, part.LiveSectors},
+			{&p.ActiveSectors, part.ActiveSectors},
+		} {
+			bf, err := f.get()
+			if err != nil {
+				return err
+			}
+			*f.dst = bf
+		}
+		out = append(out, p)
+		return nil
+	})
+	return out, err
+}
+
+func (n *offlineNode) StateMinerSectors(ctx context.Context, addr address.Address, sectorNos *bitfield.BitField, tsk types.TipSetKey) ([]*miner.SectorOnChainInfo, error) {
+	mas, _, err := n.loadMiner(ctx, addr, tsk)
+	if err != nil {
+		return nil, err
+	}
+	return mas.LoadSectors(sectorNos)
+}
+
+func (n *offlineNode) StateMinerDeadlines(ctx context.Context, addr address.Address, tsk types.TipSetKey) ([]api.Deadline, error) {
+	mas, _, err := n.loadMiner(ctx, addr, tsk)
+	if err != nil {
+		return nil, err
+	}
+	num, err := mas.NumDeadlines()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]api.Deadline, num)
+	err = mas.ForEachDeadline(func(i uint64, dl miner.Deadline) error {
+		ps, err := dl.PartitionsPoSted()
+		if err != nil {
+			return err
+		}
+		l, err := dl.DisputableProofCount()
+		if err != nil {
+			return err
+		}
+		dailyFee, err := dl.DailyFee()
+		if err != nil {
+			return err
+		}
+		out[i] = api.Deadline{
+			PostSubmissions:      ps,
+			DisputableProofCount: l,
+			DailyFee:             dailyFee,
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (n *offlineNode) StateVMCirculatingSupplyInternal(context.Context, types.TipSetKey) (api.CirculatingSupply, error) {
+	return api.CirculatingSupply{}, fmt.Errorf("circulating supply is not available in offline mode")
+}
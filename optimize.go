@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+)
+
+// terminationPlan 是一组待终结的扇区
+type terminationPlan struct {
+	Target  string `json:"target"`
+	Pledge  string `json:"pledge"`
+	Penalty string `json:"penalty"`
+	// exact 为精确的最小罚金，greedy 为贪心近似，不保证罚金最小
+	Method  string           `json:"method"`
+	Sectors []*sectorPenalty `json:"sectors"`
+}
+
+const (
+	optimizeExact  = "exact"
+	optimizeGreedy = "greedy"
+)
+
+// 可选的单位不超过 exactUnits 个时穷举求精确解，否则用贪心近似
+const exactUnits = 20
+
+// terminationUnit 是优化时不可拆分的单位，一个扇区或整个 partition
+type terminationUnit struct {
+	rows    []*sectorPenalty
+	pledge  abi.TokenAmount
+	penalty abi.TokenAmount
+}
+
+func penaltyOptimize(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+		req, ok := parsePenaltyRequest(lapi, c, false)
+		if !ok {
+			return
+		}
+		// 已经过期或终结的扇区不能再终结
+		req.allSectors = false
+		target, err := types.ParseFIL(c.Query("pledge"))
+		if err != nil || !abi.TokenAmount(target).GreaterThan(big.Zero()) {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  "please specify the pledge (FIL) to release",
+			})
+			return
+		}
+		wholePartitions, _ := strconv.ParseBool(c.DefaultQuery("partitions", "0"))
+		deadlines, err := parseDeadlines(c.Query("deadlines"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  err.Error(),
+			})
+			return
+		}
+
+		plan, err := optimizeTermination(c.Request.Context(), lapi, req, abi.TokenAmount(target), wholePartitions, deadlines)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		render(c, req.ts, f, &result{data: plan, records: plan.Sectors, table: plan.table()})
+	}
+}
+
+func (plan *terminationPlan) table() *table {
+	t := &table{Header: []string{"sector", "deadline", "partition", "expiration", "date", "initial_pledge", "penalty", "binding_term"}}
+	for _, r := range plan.Sectors {
+		t.Rows = append(t.Rows, []string{fmt.Sprint(r.SectorNumber), fmt.Sprint(r.Deadline), fmt.Sprint(r.Partition), fmt.Sprint(r.Expiration), r.Date, r.InitialPledge, r.Penalty, r.BindingTerm})
+	}
+	// 汇总数据，最后一列是求解方式
+	t.Rows = append(t.Rows, []string{strconv.Itoa(len(plan.Sectors)), "", "", "", "", plan.Pledge, plan.Penalty, plan.Method})
+	return t
+}
+
+// parseDeadlines 解析逗号分隔的 deadline 列表，为空表示不限制
+func parseDeadlines(s string) (map[uint64]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := make(map[uint64]bool)
+	for _, v := range strings.Split(s, ",") {
+		dl, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil || dl >= m.WPoStPeriodDeadlines {
+			return nil, fmt.Errorf("invalid deadline: %s", v)
+		}
+		out[dl] = true
+	}
+	return out, nil
+}
+
+// deadlineIsMutable 与 builtin-actors 一致，正在证明或即将证明的 deadline 不能终结扇区
+// epoch 可以在 periodStart 所在的证明周期之前或之后
+func deadlineIsMutable(periodStart abi.ChainEpoch, dlIdx uint64, epoch abi.ChainEpoch) bool {
+	if periodStart > epoch {
+		periodStart -= ((periodStart-epoch-1)/m.WPoStProvingPeriod + 1) * m.WPoStProvingPeriod
+	}
+	di := m.NewDeadlineInfo(periodStart, dlIdx, epoch).NextNotElapsed()
+	return !di.IsOpen() && epoch < di.Challenge
+}
+
+// optimizeTermination 选出释放至少 target 质押、罚金尽量少的扇区
+// 这是一个最小代价覆盖（背包）问题：先用贪心近似，按 罚金/质押 从小到大选取，
+// 达到目标后再按罚金从大到小去掉多余的单位；单位不超过 exactUnits 个时再穷举出精确解
+func optimizeTermination(ctx context.Context, lapi ChainReader, req *penaltyRequest, target abi.TokenAmount, wholePartitions bool, deadlines map[uint64]bool) (*terminationPlan, error) {
+	rows, ms, err := computeSectorPenalties(ctx, lapi, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var units []*terminationUnit
+	byPartition := make(map[calc.SectorLocation]*terminationUnit)
+	for _, r := range rows {
+		if deadlines != nil && !deadlines[r.Deadline] {
+			continue
+		}
+		// 与罚金相同，按 offset 之后的高度判断
+		if !deadlineIsMutable(ms.Deadline.PeriodStart, r.Deadline, req.ts.Height()+req.offset) {
+			continue
+		}
+		loc := calc.SectorLocation{Deadline: r.Deadline, Partition: r.Partition}
+		u, ok := byPartition[loc]
+		if !wholePartitions || !ok {
+			u = &terminationUnit{pledge: big.Zero(), penalty: big.Zero()}
+			units = append(units, u)
+			if wholePartitions {
+				byPartition[loc] = u
+			}
+		}
+		u.rows = append(u.rows, r)
+		u.pledge = big.Add(u.pledge, r.pledge)
+		u.penalty = big.Add(u.penalty, r.penalty)
+	}
+	// 不释放质押的单位不会被选中
+	nonzero := units[:0]
+	for _, u := range units {
+		if !u.pledge.IsZero() {
+			nonzero = append(nonzero, u)
+		}
+	}
+	units = nonzero
+
+	// 罚金/质押 比值从小到大，交叉相乘避免精度损失
+	sort.SliceStable(units, func(i, j int) bool {
+		return big.Mul(units[i].penalty, units[j].pledge).LessThan(big.Mul(units[j].penalty, units[i].pledge))
+	})
+
+	var selected []*terminationUnit
+	released := big.Zero()
+	for _, u := range units {
+		if released.GreaterThanEqual(target) {
+			break
+		}
+		selected = append(selected, u)
+		released = big.Add(released, u.pledge)
+	}
+	if released.LessThan(target) {
+		return nil, fmt.Errorf("only %s FIL of pledge can be released from the terminable sectors", toFIL(released))
+	}
+
+	// 去掉多余的单位，罚金大的优先
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].penalty.GreaterThan(selected[j].penalty)
+	})
+	kept := selected[:0]
+	for _, u := range selected {
+		if rest := big.Sub(released, u.pledge); rest.GreaterThanEqual(target) {
+			released = rest
+			continue
+		}
+		kept = append(kept, u)
+	}
+
+	plan := &terminationPlan{Target: toFIL(target), Method: optimizeGreedy}
+	if len(units) <= exactUnits {
+		kept = exactSelection(units, target, kept)
+		plan.Method = optimizeExact
+	}
+	pledge, penalty := big.Zero(), big.Zero()
+	for _, u := range kept {
+		plan.Sectors = append(plan.Sectors, u.rows...)
+		pledge = big.Add(pledge, u.pledge)
+		penalty = big.Add(penalty, u.penalty)
+	}
+	sort.Slice(plan.Sectors, func(i, j int) bool {
+		return plan.Sectors[i].SectorNumber < plan.Sectors[j].SectorNumber
+	})
+	plan.Pledge = toFIL(pledge)
+	plan.Penalty = toFIL(penalty)
+	return plan, nil
+}
+
+// exactSelection 穷举 units（已按 罚金/质押 排序）的组合，返回释放至少 target 质押、罚金最小的一组，
+// best 是已知的可行解，用作剪枝的上界
+func exactSelection(units []*terminationUnit, target abi.TokenAmount, best []*terminationUnit) []*terminationUnit {
+	bestPenalty := big.Zero()
+	for _, u := range best {
+		bestPenalty = big.Add(bestPenalty, u.penalty)
+	}
+	// rest[i] 是 units[i:] 的质押之和
+	rest := make([]abi.TokenAmount, len(units)+1)
+	rest[len(units)] = big.Zero()
+	for i := len(units) - 1; i >= 0; i-- {
+		rest[i] = big.Add(rest[i+1], units[i].pledge)
+	}
+
+	var chosen []*terminationUnit
+	var search func(i int, pledge, penalty abi.TokenAmount)
+	search = func(i int, pledge, penalty abi.TokenAmount) {
+		if !penalty.LessThan(bestPenalty) {
+			return
+		}
+		// 罚金不为负，达到目标后再加单位只会更多
+		if pledge.GreaterThanEqual(target) {
+			best, bestPenalty = append([]*terminationUnit{}, chosen...), penalty
+			return
+		}
+		if i == len(units) || big.Add(pledge, rest[i]).LessThan(target) {
+			return
+		}
+		chosen = append(chosen, units[i])
+		search(i+1, big.Add(pledge, units[i].pledge), big.Add(penalty, units[i].penalty))
+		chosen = chosen[:len(chosen)-1]
+		search(i+1, pledge, penalty)
+	}
+	search(0, big.Zero(), big.Zero())
+	return best
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+	"github.com/olekukonko/tablewriter"
+)
+
+// outputFormat 是 format= 支持的输出格式
+type outputFormat string
+
+const (
+	formatCSV      outputFormat = "csv"
+	formatTSV      outputFormat = "tsv"
+	formatJSON     outputFormat = "json"
+	formatNDJSON   outputFormat = "ndjson"
+	formatMarkdown outputFormat = "markdown"
+	formatTable    outputFormat = "table"
+	formatXLSX     outputFormat = "xlsx"
+)
+
+// formatTypes 是各格式的 Content-Type，也用于匹配 Accept
+var formatTypes = map[outputFormat]string{
+	formatCSV:      "text/csv",
+	formatTSV:      "text/tab-separated-values",
+	formatJSON:     "application/json",
+	formatNDJSON:   "application/x-ndjson",
+	formatMarkdown: "text/markdown",
+	formatTable:    "text/plain",
+	formatXLSX:     "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	f := outputFormat(strings.ToLower(s))
+	if f == "md" {
+		f = formatMarkdown
+	}
+	if _, ok := formatTypes[f]; !ok {
+		return "", fmt.Errorf("unknown format %s, use csv, tsv, json, ndjson, markdown, table or xlsx", s)
+	}
+	return f, nil
+}
+
+// requestFormat 按 format=、json=1、Accept 的顺序选择格式，都没有时使用 def
+func requestFormat(c *gin.Context, def outputFormat) (outputFormat, error) {
+	if v := c.Query("format"); v != "" {
+		return parseOutputFormat(v)
+	}
+	if jsonOut, _ := strconv.ParseBool(c.Query("json")); jsonOut {
+		return formatJSON, nil
+	}
+	if f, ok := acceptFormat(c.GetHeader("Accept")); ok {
+		return f, nil
+	}
+	return def, nil
+}
+
+// acceptFormat 返回 Accept 中权重最高的已知格式，*/* 等通配不匹配
+func acceptFormat(accept string) (outputFormat, bool) {
+	type candidate struct {
+		f outputFormat
+		q float64
+	}
+	var cands []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for f, t := range formatTypes {
+			if t == mt && q > 0 {
+				cands = append(cands, candidate{f, q})
+			}
+		}
+	}
+	if len(cands) == 0 {
+		return "", false
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].q > cands[j].q })
+	return cands[0].f, true
+}
+
+// formatOrAbort 格式不支持时直接返回 400
+func formatOrAbort(c *gin.Context, def outputFormat) (outputFormat, bool) {
+	f, err := requestFormat(c, def)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Code: http.StatusBadRequest,
+			Msg:  err.Error(),
+		})
+		return "", false
+	}
+	return f, true
+}
+
+// table 是表格形式的结果，除 JSON 和 NDJSON 外的格式都由它生成
+type table struct {
+	// 表格前的说明，只在 markdown 和 table 格式中输出
+	Notes  []string
+	Header []string
+	Rows   [][]string
+}
+
+// result 是一个接口的结果：json 输出 data，ndjson 每行输出 records 的一个元素，其它格式输出 table
+type result struct {
+	data interface{}
+	// 为 nil 时 data 是切片则逐个输出，否则输出 data
+	records interface{}
+	table   *table
+	// 跟在 table 之后的表格，xlsx 中每个表格一个工作表，其它格式之间空一行
+	more []*table
+}
+
+func (res *result) tables() []*table {
+	return append([]*table{res.table}, res.more...)
+}
+
+// join 依次编码每个表格，之间用 sep 分隔
+func (res *result) join(sep string, enc func(t *table) ([]byte, error)) ([]byte, error) {
+	var out []byte
+	for i, t := range res.tables() {
+		if i > 0 {
+			out = append(out, sep...)
+		}
+		data, err := enc(t)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+// text 把返回字符串的编码函数用于 join
+func text(enc func(t *table) string) func(t *table) ([]byte, error) {
+	return func(t *table) ([]byte, error) {
+		return []byte(enc(t)), nil
+	}
+}
+
+// render 按格式把 res 编码为字节，json 格式与 HTTP 接口的 APIResponse 相同
+func (res *result) render(f outputFormat, ts *types.TipSet) ([]byte, error) {
+	switch f {
+	case formatJSON:
+		return json.MarshalIndent(APIResponse{
+			Code:   http.StatusOK,
+			Msg:    "OK",
+			Data:   res.data,
+			Height: ts.Height(),
+			TipSet: ts.Cids(),
+		}, "", "  ")
+	case formatNDJSON:
+		return res.ndjson()
+	case formatCSV:
+		return res.join("\r\n", (*table).csv)
+	case formatTSV:
+		return res.join("\n", text((*table).tsv))
+	case formatMarkdown:
+		return res.join("\n", text((*table).markdown))
+	case formatTable:
+		return res.join("\n", text((*table).ascii))
+	case formatXLSX:
+		return xlsx(res.tables())
+	}
+	return nil, fmt.Errorf("unknown format %s", f)
+}
+
+func (res *result) ndjson() ([]byte, error) {
+	records := res.records
+	if records == nil {
+		records = res.data
+	}
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	v := reflect.ValueOf(records)
+	if v.Kind() != reflect.Slice {
+		err := enc.Encode(records)
+		return buf.Bytes(), err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := enc.Encode(v.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// render 按请求的格式返回 res，并带上计算所用的 tipset
+func render(c *gin.Context, ts *types.TipSet, f outputFormat, res *result) {
+	tipSetHeaders(c, ts)
+	if f == formatJSON {
+		c.JSON(http.StatusOK, APIResponse{
+			Code:   http.StatusOK,
+			Msg:    "OK",
+			Data:   res.data,
+			Height: ts.Height(),
+			TipSet: ts.Cids(),
+		})
+		return
+	}
+	data, err := res.render(f, ts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Code: http.StatusInternalServerError,
+			Msg:  err.Error(),
+		})
+		return
+	}
+	if f == formatXLSX {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(c.FullPath())+".xlsx"))
+	}
+	c.Data(http.StatusOK, formatTypes[f]+"; charset=utf-8", data)
+}
+
+// csv 按 RFC 4180 输出，换行为 CRLF
+func (t *table) csv() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.UseCRLF = true
+	for _, row := range append([][]string{t.Header}, t.Rows...) {
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *table) tsv() string {
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	var sb strings.Builder
+	for _, row := range append([][]string{t.Header}, t.Rows...) {
+		for i, v := range row {
+			if i > 0 {
+				sb.WriteByte('\t')
+			}
+			sb.WriteString(clean.Replace(v))
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func (t *table) markdown() string {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	var sb strings.Builder
+	for _, n := range t.Notes {
+		sb.WriteString(n + "  \n")
+	}
+	if len(t.Notes) > 0 {
+		sb.WriteByte('\n')
+	}
+	line := func(row []string) {
+		sb.WriteString("|")
+		for _, v := range row {
+			sb.WriteString(" " + escape.Replace(v) + " |")
+		}
+		sb.WriteByte('\n')
+	}
+	line(t.Header)
+	sep := make([]string, len(t.Header))
+	for i := range sep {
+		sep[i] = "---"
+	}
+	line(sep)
+	for _, row := range t.Rows {
+		line(row)
+	}
+	return sb.String()
+}
+
+func (t *table) ascii() string {
+	buf := new(bytes.Buffer)
+	for _, n := range t.Notes {
+		buf.WriteString(n + "\n")
+	}
+	tw := tablewriter.NewWriter(buf)
+	tw.SetHeader(t.Header)
+	tw.SetAutoFormatHeaders(false)
+	tw.SetAutoWrapText(false)
+	tw.SetAlignment(tablewriter.ALIGN_LEFT)
+	tw.SetBorder(true)
+	tw.AppendBulk(t.Rows)
+	tw.Render()
+	return buf.String()
+}
+
+// xlsxMaxDigits 是 Excel 数字能精确保存的最多位数
+const xlsxMaxDigits = 15
+
+// xlsx 生成最小的 xlsx 文件，每个表格一个工作表
+// 不超过 xlsxMaxDigits 位的整数写为数字，金额等其它值都写为文本，避免被当作浮点数舍入
+func xlsx(tables []*table) ([]byte, error) {
+	var (
+		sheets    []struct{ name, body string }
+		overrides strings.Builder
+		entries   strings.Builder
+		rels      strings.Builder
+	)
+	for n, t := range tables {
+		var sheet bytes.Buffer
+		sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+		for r, row := range append([][]string{t.Header}, t.Rows...) {
+			fmt.Fprintf(&sheet, `<row r="%d">`, r+1)
+			for i, v := range row {
+				ref := xlsxColumn(i) + strconv.Itoa(r+1)
+				if r > 0 && xlsxInteger(v) {
+					fmt.Fprintf(&sheet, `<c r="%s"><v>%s</v></c>`, ref, v)
+					continue
+				}
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+				if err := xml.EscapeText(&sheet, []byte(v)); err != nil {
+					return nil, err
+				}
+				sheet.WriteString(`</t></is></c>`)
+			}
+			sheet.WriteString(`</row>`)
+		}
+		sheet.WriteString(`</sheetData></worksheet>`)
+
+		id := n + 1
+		name := fmt.Sprintf("xl/worksheets/sheet%d.xml", id)
+		sheets = append(sheets, struct{ name, body string }{name, sheet.String()})
+		fmt.Fprintf(&overrides, `<Override PartName="/%s" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, name)
+		fmt.Fprintf(&entries, `<sheet name="Sheet%d" sheetId="%d" r:id="rId%d"/>`, id, id, id)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, id, id)
+	}
+
+	parts := append([]struct{ name, body string }{
+		{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			overrides.String() + `</Types>`},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + entries.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			rels.String() + `</Relationships>`},
+	}, sheets...)
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, p := range parts {
+		w, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xlsxInteger 判断 v 是否为 Excel 可以精确保存的整数
+func xlsxInteger(v string) bool {
+	digits := strings.TrimPrefix(v, "-")
+	if digits == "" || len(digits) > xlsxMaxDigits || digits != "0" && digits[0] == '0' {
+		return false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// xlsxColumn 把从 0 开始的列号转换为 A、B、...、AA
+func xlsxColumn(i int) string {
+	s := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		s = string(rune('A'+(i-1)%26)) + s
+	}
+	return s
+}
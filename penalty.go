@@ -1,43 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	b "math/big"
 	"net/http"
 	"sort"
 	"strconv"
-	"time"
 
+	"github.com/beck-8/sectors_penalty/calc"
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
-	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
-	s "github.com/filecoin-project/go-state-types/builtin/v16/util/smoothing"
-	gststore "github.com/filecoin-project/go-state-types/store"
-	"github.com/filecoin-project/lotus/blockstore"
-	"github.com/filecoin-project/lotus/chain/actors/builtin"
-	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
-	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
-	"github.com/filecoin-project/lotus/chain/actors/builtin/reward"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/gin-gonic/gin"
-)
-
-// https://github.com/filecoin-project/FIPs/blob/master/FIPS/fip-0098.md#specification
-var (
-	TERMINATION_LIFETIME_CAP = int64(140)
-
-	TERM_FEE_PLEDGE_MULTIPLE_NUM   = big.NewInt(85)
-	TERM_FEE_PLEDGE_MULTIPLE_DENOM = big.NewInt(1000)
-
-	TERM_FEE_MIN_PLEDGE_MULTIPLE_NUM   = big.NewInt(2)
-	TERM_FEE_MIN_PLEDGE_MULTIPLE_DENOM = big.NewInt(100)
-
-	TERM_FEE_MAX_FAULT_FEE_MULTIPLE_NUM   = big.NewInt(105)
-	TERM_FEE_MAX_FAULT_FEE_MULTIPLE_DENOM = big.NewInt(100)
-
-	nv25Height = abi.ChainEpoch(4878840)
+	"github.com/ipfs/go-cid"
 )
 
 type APIResponse struct {
@@ -45,323 +22,270 @@ type APIResponse struct {
 	Level int         `json:"level"`
 	Msg   string      `json:"msg"`
 	Data  interface{} `json:"data"`
+	// 计算所用的 tipset
+	Height abi.ChainEpoch `json:"height,omitempty"`
+	TipSet []cid.Cid      `json:"tipset,omitempty"`
+}
+
+// penaltyRequest 是 /penalty 系列接口共用的参数
+type penaltyRequest struct {
+	mid address.Address
+	// /penalty 可以指定多个矿工，mid 为第一个
+	mids       []address.Address
+	many       bool
+	allSectors bool
+	// 相对 ts 的高度偏移
+	offset abi.ChainEpoch
+	proj   calc.Projection
+	// /penalty 是否附带 FIP-100 日费日历
+	fees bool
+	ts   *types.TipSet
 }
 
-func penalty(c *gin.Context) {
+// parsePenaltyRequest 解析参数，出错时已经写好响应并返回 false，multi 为 false 时只接受一个矿工
+func parsePenaltyRequest(lapi ChainReader, c *gin.Context, multi bool) (*penaltyRequest, bool) {
 	// 获取查询参数值
-	miner := c.Query("miner")
-	if miner == "" {
-		c.JSON(http.StatusBadRequest, APIResponse{
-			Code: http.StatusBadRequest,
-			Msg:  "please specify a miner",
-		})
-		return
+	q, ok := minerQueryOrAbort(c, multi)
+	if !ok {
+		return nil, false
 	}
-	mid, err := address.NewFromString(miner)
+
+	allSectors, _ := strconv.ParseBool(c.DefaultQuery("all", "0"))
+
+	// 往后/往前 推多少天
+	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+
+	fees, _ := strconv.ParseBool(c.DefaultQuery("fees", "0"))
+
+	// offset 为负数时默认沿用当前状态只平移扇区年龄，history=1 则读取当时的链状态（需要节点有历史状态）
+	history, _ := strconv.ParseBool(c.DefaultQuery("history", "0"))
+
+	// offset 为正数时，把平滑估计外推到目标日期
+	proj, err := parseProjection(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, APIResponse{
 			Code: http.StatusBadRequest,
 			Msg:  err.Error(),
 		})
-		return
+		return nil, false
 	}
 
-	allSectors, _ := strconv.ParseBool(c.DefaultQuery("all", "0"))
-
-	// 往后/往前 推多少天
-	offset, _ := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
-
-	jsonOut, _ := strconv.ParseBool(c.DefaultQuery("json", "0"))
+	ts, ok := tipSetOrAbort(lapi, c)
+	if !ok {
+		return nil, false
+	}
+	mids, ok := resolveOrAbort(lapi, c, q, ts)
+	if !ok {
+		return nil, false
+	}
 
-	data, err := Compute(mid, allSectors, abi.ChainEpoch(offset*2880), jsonOut)
+	ts, epochOffset, err := historyTipSet(c.Request.Context(), lapi, ts, abi.ChainEpoch(offset)*netProfile.epochsPerDay(), history)
 	if err != nil {
-		log.Printf("%v\n", err)
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Code: http.StatusInternalServerError,
 			Msg:  err.Error(),
 		})
-		return
-	}
-	if jsonOut {
-		c.JSON(http.StatusOK, APIResponse{
-			Code: http.StatusOK,
-			Msg:  "OK",
-			Data: data,
-		})
-	} else {
-		c.String(200, data.(string))
+		return nil, false
 	}
 
+	return &penaltyRequest{
+		mid:        mids[0],
+		mids:       mids,
+		many:       q.many(),
+		allSectors: allSectors,
+		offset:     epochOffset,
+		proj:       proj,
+		fees:       fees,
+		ts:         ts,
+	}, true
 }
 
-func Compute(mid address.Address, allSectors bool, offset abi.ChainEpoch, jsonOut bool) (interface{}, error) {
-
-	type dailyData struct {
-		penalty abi.TokenAmount
-		info    map[uint64]abi.TokenAmount
+// historyTipSet offset 为负数且 history 时改为读取当时的链状态，返回新的 tipset 和剩余的 offset
+func historyTipSet(ctx context.Context, lapi ChainReader, ts *types.TipSet, offset abi.ChainEpoch, history bool) (*types.TipSet, abi.ChainEpoch, error) {
+	if offset >= 0 || !history {
+		return ts, offset, nil
 	}
-
-	tsk, err := lapi.ChainHead(ctx)
+	ts, err := lapi.ChainGetTipSetByHeight(ctx, ts.Height()+offset, ts.Key())
 	if err != nil {
-		return "", err
-	}
-
-	minerInfo, err := lapi.StateMinerInfo(ctx, mid, types.EmptyTSK)
-	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
+	return ts, 0, nil
+}
 
-	cd, err := lapi.StateMinerProvingDeadline(ctx, mid, tsk.Key())
-	if err != nil {
-		return "", err
-	}
-	//todo: pre-allocation
-	liveSectors := make(map[uint64]bool)
-	deadlines := make(map[uint64]int)
-	for i := 0; i < 48; i++ {
-		partitions, err := lapi.StateMinerPartitions(ctx, mid, uint64(i), types.EmptyTSK)
-		if err != nil {
-			return "", err
+func penalty(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
 		}
-		for _, part := range partitions {
-			count, err := part.AllSectors.Count()
-			if err != nil {
-				return "", err
-			}
-			sectors, err := part.AllSectors.All(count)
-			if err != nil {
-				return "", err
-			}
-			for _, sec := range sectors {
-				deadlines[sec] = i
-			}
-
-			liveCount, err := part.LiveSectors.Count()
-			if err != nil {
-				return "", err
-			}
-			liveSector, err := part.LiveSectors.AllMap(liveCount)
-			if err != nil {
-				return "", err
-			}
-			for k, v := range liveSector {
-				liveSectors[k] = v
-			}
+		req, ok := parsePenaltyRequest(lapi, c, true)
+		if !ok {
+			return
 		}
-	}
 
-	var onChainInfo []*miner.SectorOnChainInfo
-	if allSectors {
-		onChainInfo, err = lapi.StateMinerSectors(ctx, mid, nil, types.EmptyTSK)
-		if err != nil {
-			return "", err
+		var res *result
+		var err error
+		if req.many {
+			res, err = computeMiners(c.Request.Context(), lapi, req.ts, req.mids, req.allSectors, req.offset, req.proj, req.fees)
+		} else {
+			res, err = Compute(c.Request.Context(), lapi, req.ts, req.mid, req.allSectors, req.offset, req.proj, req.fees)
 		}
-	} else {
-		tmp, err := lapi.StateMinerSectors(ctx, mid, nil, types.EmptyTSK)
 		if err != nil {
-			return "", err
-		}
-		for _, v := range tmp {
-			if liveSectors[uint64(v.SectorNumber)] {
-				onChainInfo = append(onChainInfo, v)
-			}
+			log.Printf("%v\n", err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
 		}
-	}
+		render(c, req.ts, f, res)
 
-	rewardEstimate, networkQAPowerEstimate, err := GetSmoothing(tsk)
-	if err != nil {
-		return "", err
 	}
+}
 
-	sumData := make(map[string]*dailyData, 540)
-	for _, info := range onChainInfo {
-		// date := heightToTime(int64(info.Expiration) + int64(deadlines[uint64(info.SectorNumber)]*60))
-		// 上述已丢弃，弃用，应该是nv15丢弃的
-		date := heightToTime(int64(m.QuantSpecForDeadline(m.NewDeadlineInfo(cd.PeriodStart, uint64(deadlines[uint64(info.SectorNumber)]), 0)).QuantizeUp(info.Expiration)))
-
-		var penalty abi.TokenAmount
-
-		if tsk.Height() < nv25Height {
-			// https://github.com/filecoin-project/builtin-actors/blob/54236ae89880bf4aa89b0dba6d9060c3fd2aacee/actors/miner/src/monies.rs#L202
-			// ctrl c ctrl v 的，所以没有遵循golang的命名规范
-			lifetime_cap := int64(140 * 2880)
-			var capped_sector_age int64
-			if sector_age := int64(tsk.Height()+offset) - int64(info.PowerBaseEpoch); lifetime_cap < sector_age {
-				capped_sector_age = lifetime_cap
-			} else {
-				capped_sector_age = sector_age
-			}
-			if capped_sector_age < 0 {
-				capped_sector_age = 0
-			}
-			expected_reward := big.Mul(*info.ExpectedDayReward, big.NewInt(capped_sector_age))
-
-			var relevant_replaced_age int64
-			if replaced_sector_age := int64(info.PowerBaseEpoch) - int64(info.Activation); replaced_sector_age < lifetime_cap-capped_sector_age {
-				relevant_replaced_age = replaced_sector_age
-			} else {
-				relevant_replaced_age = lifetime_cap - capped_sector_age
-			}
-			expected_reward = big.Add(expected_reward, big.Mul(*info.ReplacedDayReward, big.NewInt(relevant_replaced_age)))
-			expected_reward = big.Div(expected_reward, big.NewInt(2))
-
-			penalty = big.Add(*info.ExpectedStoragePledge, big.Div(expected_reward, big.NewInt(2880)))
+// penaltyDay 是 /penalty 中的一行
+type penaltyDay struct {
+	Date        string  `json:"date"`
+	Mid         string  `json:"mid"`
+	Sectors_sum int     `json:"sectors_sum"`
+	Power       float64 `json:"power"`
+	Pledge      string  `json:"pledge"`
+	Penalty     string  `json:"penalty"`
+	// fees=1 时的 FIP-100 日费日历：当天过期扇区的日费（从这天起不再扣除）、
+	// 这些扇区过期前还要扣除的总费用、当天预计扣除的日费
+	DailyFeeStop string `json:"daily_fee_stop,omitempty"`
+	FeeLiability string `json:"fee_liability,omitempty"`
+	FeeOutflow   string `json:"fee_outflow,omitempty"`
+}
 
-			// 说明用户把offset设置了很大的负数，这个时候罚金就是ExpectedStoragePledge
-			// 这样处理后，t = tsk.Height()+offset，t在上次续期时间之后是准确的；t在扇区激活-上次续期时间之间是不太准确的；t在扇区激活之前是准确的。
-			// |----|--bad--|----|
-			if tsk.Height()+offset < info.Activation {
-				penalty = *info.ExpectedStoragePledge
-			}
-		} else {
+// Compute 按过期日期汇总扇区数、算力、质押和终结罚金，fees 为 true 时合并日费日历，直到最后一个扇区过期的每一天都有一行
+func Compute(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address, allSectors bool, offset abi.ChainEpoch, proj calc.Projection, fees bool) (*result, error) {
+	days, err := expirationDays(ctx, lapi, tsk, mid, allSectors, offset, proj)
+	if err != nil {
+		return nil, err
+	}
+	if !fees {
+		dayDatas := newPenaltyDays(mid.String(), days)
+		return &result{data: dayDatas, table: penaltyTable(dayDatas, days, nil)}, nil
+	}
+	outflow, err := feeOutflow(ctx, lapi, tsk, mid, allSectors, offset)
+	if err != nil {
+		return nil, err
+	}
+	dayDatas := newFeePenaltyDays(mid.String(), days, outflow)
+	return &result{data: dayDatas, table: penaltyTable(dayDatas, days, outflow)}, nil
+}
 
-			penalty = PledgePenaltyForTermination(info.InitialPledge, int64(tsk.Height()+offset-info.Activation), FaultFee(minerInfo.SectorSize, info, rewardEstimate, networkQAPowerEstimate))
-		}
+// feeOutflow 矿工从 ts.Height()+offset 起每天预计扣除的日费
+func feeOutflow(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address, allSectors bool, offset abi.ChainEpoch) ([]*calc.FeeDay, error) {
+	ms, err := calc.LoadMinerSectors(ctx, lapi, tsk, mid, allSectors)
+	if err != nil {
+		return nil, err
+	}
+	return ms.FeeOutflow(tsk.Height()+offset, func(epoch abi.ChainEpoch) string {
+		return heightToTime(int64(epoch))
+	}), nil
+}
 
-		if data, ok := sumData[date]; ok {
-			data.info[uint64(info.SectorNumber)] = info.InitialPledge
-			data.penalty = big.Add(data.penalty, penalty)
-		} else {
-			sumData[date] = &dailyData{penalty: penalty, info: make(map[uint64]abi.TokenAmount)}
+// expirationDays 按过期日期汇总矿工的扇区
+func expirationDays(ctx context.Context, lapi ChainReader, tsk *types.TipSet, mid address.Address, allSectors bool, offset abi.ChainEpoch, proj calc.Projection) ([]*calc.ExpirationDay, error) {
+	rows, ms, err := calc.SectorPenalties(ctx, lapi, tsk, mid, calc.PenaltyOptions{AllSectors: allSectors, Offset: offset, Projection: proj})
+	if err != nil {
+		return nil, err
+	}
+	// date := heightToTime(int64(info.Expiration) + int64(deadlines[uint64(info.SectorNumber)]*60))
+	// 上述已丢弃，弃用，应该是nv15丢弃的
+	return calc.ExpirationsByDay(rows, ms.Info.SectorSize, func(epoch abi.ChainEpoch) string {
+		return heightToTime(int64(epoch))
+	}), nil
+}
 
-			sumData[date].info[uint64(info.SectorNumber)] = info.InitialPledge
+func newPenaltyDays(mid string, days []*calc.ExpirationDay) []*penaltyDay {
+	dayDatas := make([]*penaltyDay, 0, len(days))
+	for _, d := range days {
+		dayDatas = append(dayDatas, &penaltyDay{
+			Date:        d.Day,
+			Mid:         mid,
+			Sectors_sum: d.Sectors,
+			Power:       toTiB(d.Power),
+			Pledge:      toFIL(d.Pledge),
+			Penalty:     toFIL(d.Penalty),
+		})
+	}
+	return dayDatas
+}
 
+// newFeePenaltyDays 按日期合并过期日历和日费支出，只有日费支出的日期其它列为 0
+func newFeePenaltyDays(mid string, days []*calc.ExpirationDay, outflow []*calc.FeeDay) []*penaltyDay {
+	byDay := make(map[string]*penaltyDay, len(days)+len(outflow))
+	for _, d := range days {
+		row := newPenaltyDays(mid, []*calc.ExpirationDay{d})[0]
+		row.DailyFeeStop = toFIL(d.DailyFee)
+		row.FeeLiability = toFIL(d.RemainingFee)
+		row.FeeOutflow = toFIL(big.Zero())
+		byDay[d.Day] = row
+	}
+	for _, d := range outflow {
+		row, ok := byDay[d.Day]
+		if !ok {
+			row = &penaltyDay{Date: d.Day, Mid: mid, Pledge: toFIL(big.Zero()), Penalty: toFIL(big.Zero()), DailyFeeStop: toFIL(big.Zero()), FeeLiability: toFIL(big.Zero())}
+			byDay[d.Day] = row
 		}
+		row.FeeOutflow = toFIL(d.Fee)
 	}
-
-	// 将 map 中的键值对提取到切片中
-	var sortedKeys []string
-	for key := range sumData {
-		sortedKeys = append(sortedKeys, key)
+	rows := make([]*penaltyDay, 0, len(byDay))
+	for _, row := range byDay {
+		rows = append(rows, row)
 	}
-	// 对切片进行排序（按日期键的规则）
-	sort.Slice(sortedKeys, func(i, j int) bool {
-		return sortedKeys[i] < sortedKeys[j]
-	})
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Date < rows[j].Date })
+	return rows
+}
 
-	type dayData struct {
-		Date        string          `json:"date"`
-		Mid         address.Address `json:"mid"`
-		Sectors_sum int             `json:"sectors_sum"`
-		Power       float64         `json:"power"`
-		Pledge      string          `json:"pledge"`
-		Penalty     string          `json:"penalty"`
+// penaltyTable 输出 rows，最后一行是 total 和 outflow 的汇总，outflow 为 nil 时不输出日费列
+func penaltyTable(rows []*penaltyDay, total []*calc.ExpirationDay, outflow []*calc.FeeDay) *table {
+	t := &table{Header: []string{"date", "mid", "sectors_sum", "power(TiB)", "pledge", "penalty"}}
+	if outflow != nil {
+		t.Header = append(t.Header, "daily_fee_stop", "fee_liability", "fee_outflow")
+	}
+	for _, r := range rows {
+		row := []string{r.Date, r.Mid, strconv.Itoa(r.Sectors_sum), fmt.Sprint(r.Power), r.Pledge, r.Penalty}
+		if outflow != nil {
+			row = append(row, r.DailyFeeStop, r.FeeLiability, r.FeeOutflow)
+		}
+		t.Rows = append(t.Rows, row)
 	}
-	dayDatas := make([]*dayData, 0)
-	outData := ""
-	// 表头
-	outData += fmt.Sprintln("date,mid,sectors_sum,power(TiB),pledge,penalty")
 
 	sectors_sum := 0
-	power := abi.SectorSize(0)
+	power := abi.NewStoragePower(0)
 	pledge := abi.NewTokenAmount(0)
 	penalty := abi.NewTokenAmount(0)
-
-	for _, date := range sortedKeys {
-		data := sumData[date]
-		daliyPledge := abi.NewTokenAmount(0)
-		seLen := len(data.info)
-		for _, v := range data.info {
-			daliyPledge = big.Add(daliyPledge, v)
-		}
-		structData := &dayData{
-			Date:        date,
-			Mid:         mid,
-			Sectors_sum: seLen,
-			Power:       float64(minerInfo.SectorSize*abi.SectorSize(seLen)) / (1 << 40),
-			Pledge:      new(b.Rat).SetFrac(daliyPledge.Int, b.NewInt(1e18)).FloatString(10),
-			Penalty:     new(b.Rat).SetFrac(data.penalty.Int, b.NewInt(1e18)).FloatString(10),
-		}
-		dayDatas = append(dayDatas, structData)
-		outData += fmt.Sprintf("%v,%v,%v,%v,%v,%v\n", date, mid, seLen, structData.Power, structData.Pledge, structData.Penalty)
-
-		sectors_sum += seLen
-		power += minerInfo.SectorSize * abi.SectorSize(seLen)
-		pledge = big.Add(pledge, daliyPledge)
-		penalty = big.Add(penalty, data.penalty)
+	for _, d := range total {
+		sectors_sum += d.Sectors
+		power = big.Add(power, d.Power)
+		pledge = big.Add(pledge, d.Pledge)
+		penalty = big.Add(penalty, d.Penalty)
 	}
 	// 汇总数据
-	outData += fmt.Sprintf(",,%v,%v,%v,%v\n", sectors_sum, float64(power)/(1<<40), new(b.Rat).SetFrac(pledge.Int, b.NewInt(1e18)).FloatString(10), new(b.Rat).SetFrac(penalty.Int, b.NewInt(1e18)).FloatString(10))
-
-	if jsonOut {
-		return dayDatas, nil
+	sum := []string{"", "", strconv.Itoa(sectors_sum), fmt.Sprint(toTiB(power)), toFIL(pledge), toFIL(penalty)}
+	if outflow != nil {
+		dailyFee, liability, out := big.Zero(), big.Zero(), big.Zero()
+		for _, d := range total {
+			dailyFee = big.Add(dailyFee, d.DailyFee)
+			liability = big.Add(liability, d.RemainingFee)
+		}
+		for _, d := range outflow {
+			out = big.Add(out, d.Fee)
+		}
+		sum = append(sum, toFIL(dailyFee), toFIL(liability), toFIL(out))
 	}
-	return outData, nil
+	t.Rows = append(t.Rows, sum)
+	return t
 }
 
 func heightToTime(height int64) string {
-	timestamp := bootstrapTime + height*30
-	// 使用 time.Unix() 将时间戳转换为日期
-	dateTime := time.Unix(timestamp, 0)
+	// 按当前网络的创世时间和出块间隔换算
+	dateTime := netProfile.timeAt(abi.ChainEpoch(height))
 	// 将日期转换为指定格式的字符串
 	dateString := dateTime.Format(dateFormat)
 	return dateString
 }
-
-// copy from builtin-actors
-func PledgePenaltyForTermination(initial_pledge abi.TokenAmount, sector_age int64, fault_fee abi.TokenAmount) abi.TokenAmount {
-	simple_termination_fee := big.Div(big.Mul(initial_pledge, TERM_FEE_PLEDGE_MULTIPLE_NUM), TERM_FEE_PLEDGE_MULTIPLE_DENOM)
-	duration_termination_fee := big.Div(big.Mul(big.NewInt(sector_age), simple_termination_fee), big.NewInt(TERMINATION_LIFETIME_CAP*2880))
-	base_termination_fee := big.Min(simple_termination_fee, duration_termination_fee)
-
-	minimum_fee_abs := big.Div(big.Mul(initial_pledge, TERM_FEE_MIN_PLEDGE_MULTIPLE_NUM), TERM_FEE_MIN_PLEDGE_MULTIPLE_DENOM)
-	minimum_fee_ff := big.Div(big.Mul(fault_fee, TERM_FEE_MAX_FAULT_FEE_MULTIPLE_NUM), TERM_FEE_MAX_FAULT_FEE_MULTIPLE_DENOM)
-	minimum_fee := big.Max(minimum_fee_abs, minimum_fee_ff)
-
-	return big.Max(base_termination_fee, minimum_fee)
-}
-
-// pub const CONTINUED_FAULT_PROJECTION_PERIOD: ChainEpoch = (EPOCHS_IN_DAY * CONTINUED_FAULT_FACTOR_NUM) / CONTINUED_FAULT_FACTOR_DENOM;
-// 3.51 * dayward
-func FaultFee(size abi.SectorSize, info *m.SectorOnChainInfo, rewardEstimate s.FilterEstimate, networkQAPowerEstimate s.FilterEstimate) abi.TokenAmount {
-	qaPower := m.QAPowerForSector(size, info)
-	fee := m.ExpectedRewardForPower(rewardEstimate, networkQAPowerEstimate, qaPower, 10108)
-	return fee
-}
-
-func GetSmoothing(ts *types.TipSet) (s.FilterEstimate, s.FilterEstimate, error) {
-	bs := blockstore.NewAPIBlockstore(lapi)
-	ctxStore := gststore.WrapBlockStore(ctx, bs)
-
-	powerActor, err := lapi.StateGetActor(ctx, power.Address, ts.Key())
-	if err != nil {
-		return s.FilterEstimate{}, s.FilterEstimate{}, err
-	}
-
-	powerState, err := power.Load(ctxStore, powerActor)
-	if err != nil {
-		return s.FilterEstimate{}, s.FilterEstimate{}, err
-	}
-
-	rewardActor, err := lapi.StateGetActor(ctx, reward.Address, ts.Key())
-	if err != nil {
-		return s.FilterEstimate{}, s.FilterEstimate{}, err
-	}
-
-	rewardState, err := reward.Load(ctxStore, rewardActor)
-	if err != nil {
-		return s.FilterEstimate{}, s.FilterEstimate{}, err
-	}
-
-	networkQAPower, err := powerState.TotalPowerSmoothed()
-	if err != nil {
-		return s.FilterEstimate{}, s.FilterEstimate{}, err
-	}
-
-	thisEpochRewardSmoothed, err := rewardState.(interface {
-		ThisEpochRewardSmoothed() (builtin.FilterEstimate, error)
-	}).ThisEpochRewardSmoothed()
-	if err != nil {
-		return s.FilterEstimate{}, s.FilterEstimate{}, err
-	}
-
-	rewardEstimate := s.FilterEstimate{
-		PositionEstimate: thisEpochRewardSmoothed.PositionEstimate,
-		VelocityEstimate: thisEpochRewardSmoothed.VelocityEstimate,
-	}
-	networkQAPowerEstimate := s.FilterEstimate{
-		PositionEstimate: networkQAPower.PositionEstimate,
-		VelocityEstimate: networkQAPower.VelocityEstimate,
-	}
-	return rewardEstimate, networkQAPowerEstimate, nil
-}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/gin-gonic/gin"
+)
+
+// parseProjection 解析 project=1、reward_growth=、power_growth= 参数
+// 指定了增长率时自动开启外推
+func parseProjection(c *gin.Context) (calc.Projection, error) {
+	p := calc.Projection{EpochsPerDay: netProfile.epochsPerDay()}
+	p.Enabled, _ = strconv.ParseBool(c.DefaultQuery("project", "0"))
+	for _, g := range []struct {
+		key string
+		dst **float64
+	}{
+		{"reward_growth", &p.RewardGrowth},
+		{"power_growth", &p.PowerGrowth},
+	} {
+		v := c.Query(g.key)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= -1 {
+			return p, fmt.Errorf("invalid %s: %s", g.key, v)
+		}
+		*g.dst = &f
+		p.Enabled = true
+	}
+	return p, nil
+}
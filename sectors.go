@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	b "math/big"
+	"net/http"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/gin-gonic/gin"
+)
+
+type sectorPenalty struct {
+	SectorNumber        abi.SectorNumber `json:"sector_number"`
+	Deadline            uint64           `json:"deadline"`
+	Partition           uint64           `json:"partition"`
+	Activation          abi.ChainEpoch   `json:"activation"`
+	PowerBaseEpoch      abi.ChainEpoch   `json:"power_base_epoch"`
+	Expiration          abi.ChainEpoch   `json:"expiration"`
+	QuantizedExpiration abi.ChainEpoch   `json:"quantized_expiration"`
+	Date                string           `json:"date"`
+	InitialPledge       string           `json:"initial_pledge"`
+	QAPower             abi.StoragePower `json:"qa_power"`
+	Age                 abi.ChainEpoch   `json:"age"`
+	FaultFee            string           `json:"fault_fee"`
+	Penalty             string           `json:"penalty"`
+	BindingTerm         string           `json:"binding_term"`
+
+	// 未格式化的质押与罚金
+	pledge  abi.TokenAmount
+	penalty abi.TokenAmount
+}
+
+func penaltySectors(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+		req, ok := parsePenaltyRequest(lapi, c, false)
+		if !ok {
+			return
+		}
+
+		rows, _, err := computeSectorPenalties(c.Request.Context(), lapi, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		render(c, req.ts, f, &result{data: rows, table: sectorPenaltyTable(rows)})
+	}
+}
+
+func sectorPenaltyTable(rows []*sectorPenalty) *table {
+	t := &table{Header: []string{"sector", "deadline", "partition", "activation", "power_base_epoch", "expiration", "quantized_expiration", "date", "initial_pledge", "qa_power", "age", "fault_fee", "penalty", "binding_term"}}
+	for _, r := range rows {
+		t.Rows = append(t.Rows, []string{fmt.Sprint(r.SectorNumber), fmt.Sprint(r.Deadline), fmt.Sprint(r.Partition), fmt.Sprint(r.Activation), fmt.Sprint(r.PowerBaseEpoch), fmt.Sprint(r.Expiration), fmt.Sprint(r.QuantizedExpiration), r.Date, r.InitialPledge, r.QAPower.String(), fmt.Sprint(r.Age), r.FaultFee, r.Penalty, r.BindingTerm})
+	}
+	return t
+}
+
+// computeSectorPenalties 逐个扇区计算终结罚金
+func computeSectorPenalties(ctx context.Context, lapi ChainReader, req *penaltyRequest) ([]*sectorPenalty, *calc.MinerSectors, error) {
+	ps, ms, err := calc.SectorPenalties(ctx, lapi, req.ts, req.mid, calc.PenaltyOptions{AllSectors: req.allSectors, Offset: req.offset, Projection: req.proj})
+	if err != nil {
+		return nil, nil, err
+	}
+	rows := make([]*sectorPenalty, 0, len(ps))
+	for _, p := range ps {
+		rows = append(rows, &sectorPenalty{
+			SectorNumber:        p.SectorNumber,
+			Deadline:            p.Deadline,
+			Partition:           p.Partition,
+			Activation:          p.Activation,
+			PowerBaseEpoch:      p.PowerBaseEpoch,
+			Expiration:          p.Expiration,
+			QuantizedExpiration: p.QuantizedExpiration,
+			Date:                heightToTime(int64(p.QuantizedExpiration)),
+			InitialPledge:       toFIL(p.InitialPledge),
+			QAPower:             p.QAPower,
+			Age:                 p.Age,
+			FaultFee:            toFIL(p.FaultFee),
+			Penalty:             toFIL(p.Penalty),
+			BindingTerm:         p.BindingTerm,
+			pledge:              p.InitialPledge,
+			penalty:             p.Penalty,
+		})
+	}
+	return rows, ms, nil
+}
+
+// FIL 字符串的小数位数和舍入方式，由 -fil-precision 和 -fil-rounding 设置
+var (
+	filPrecision = 10
+	filRounding  = calc.RoundHalfUp
+)
+
+// toFIL 把 attoFIL 转换为 FIL 字符串，默认保留 10 位小数
+func toFIL(v abi.TokenAmount) string {
+	return calc.FormatFIL(v, filPrecision, filRounding)
+}
+
+// filAmount 是同时给出 attoFIL 整数和 FIL 字符串的金额
+type filAmount struct {
+	Atto abi.TokenAmount `json:"atto"`
+	FIL  string          `json:"fil"`
+}
+
+func newFILAmount(v abi.TokenAmount) filAmount {
+	return filAmount{Atto: v, FIL: toFIL(v)}
+}
+
+// toTiB 把字节转换为 TiB
+func toTiB(v abi.StoragePower) float64 {
+	f, _ := new(b.Rat).SetFrac(v.Int, b.NewInt(1<<40)).Float64()
+	return f
+}
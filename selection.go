@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	rlepluslazy "github.com/filecoin-project/go-bitfield/rle"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+)
+
+// sectorSelection 按扇区号、deadline 和过期日期选择扇区，多个条件同时满足才会被选中
+type sectorSelection struct {
+	// 为 nil 时不按扇区号筛选
+	sectors   *bitfield.BitField
+	deadlines map[uint64]bool
+	// 过期日期范围（含），与 /penalty 中的日期一致
+	from, to *time.Time
+}
+
+// 一个 a-b 区间最多包含的扇区数
+const maxSectorRange = 1 << 24
+
+// parseSelection 解析 sectors=1,2,10-20、deadlines=、from=、to= 参数
+func parseSelection(c *gin.Context) (*sectorSelection, error) {
+	sel := &sectorSelection{}
+	var err error
+	if sel.sectors, err = parseSectorNumbers(c.Query("sectors")); err != nil {
+		return nil, err
+	}
+	if sel.deadlines, err = parseDeadlines(c.Query("deadlines")); err != nil {
+		return nil, err
+	}
+	for _, d := range []struct {
+		key string
+		dst **time.Time
+	}{
+		{"from", &sel.from},
+		{"to", &sel.to},
+	} {
+		v := c.Query(d.key)
+		if v == "" {
+			continue
+		}
+		t, err := time.ParseInLocation(dateFormat, v, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", d.key, err)
+		}
+		*d.dst = &t
+	}
+	if sel.sectors == nil && sel.deadlines == nil && sel.from == nil && sel.to == nil {
+		return nil, fmt.Errorf("please select sectors by sectors, deadlines, from or to")
+	}
+	return sel, nil
+}
+
+// parseSectorNumbers 解析逗号分隔的扇区号，支持 a-b 区间，每个区间作为一段 run 合并到 bitfield 中
+func parseSectorNumbers(s string) (*bitfield.BitField, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := bitfield.New()
+	for _, v := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(v), "-")
+		start, err := strconv.ParseUint(lo, 10, 64)
+		if err != nil || start > abi.MaxSectorNumber {
+			return nil, fmt.Errorf("invalid sector number: %s", v)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.ParseUint(hi, 10, 64); err != nil || end < start || end > abi.MaxSectorNumber {
+				return nil, fmt.Errorf("invalid sector range: %s", v)
+			}
+			if end-start >= maxSectorRange {
+				return nil, fmt.Errorf("sector range %s has more than %d sectors", v, maxSectorRange)
+			}
+		}
+		runs := []rlepluslazy.Run{{Val: false, Len: start}, {Val: true, Len: end - start + 1}}
+		if start == 0 {
+			runs = runs[1:]
+		}
+		bf, err := bitfield.NewFromIter(&rlepluslazy.RunSliceIterator{Runs: runs})
+		if err != nil {
+			return nil, err
+		}
+		if out, err = bitfield.MergeBitFields(out, bf); err != nil {
+			return nil, err
+		}
+	}
+	return &out, nil
+}
+
+func (sel *sectorSelection) match(r *sectorPenalty) bool {
+	if sel.sectors != nil {
+		if ok, err := sel.sectors.IsSet(uint64(r.SectorNumber)); err != nil || !ok {
+			return false
+		}
+	}
+	if sel.deadlines != nil && !sel.deadlines[r.Deadline] {
+		return false
+	}
+	day := netProfile.timeAt(dayStartHeight(r.QuantizedExpiration))
+	if sel.from != nil && day.Before(*sel.from) {
+		return false
+	}
+	if sel.to != nil && day.After(*sel.to) {
+		return false
+	}
+	return true
+}
+
+// partitionSectors 是同一个 partition 中被选中的扇区
+type partitionSectors struct {
+	calc.SectorLocation
+	rows []*sectorPenalty
+}
+
+func (p *partitionSectors) bitfield() bitfield.BitField {
+	nums := make([]uint64, len(p.rows))
+	for i, r := range p.rows {
+		nums[i] = uint64(r.SectorNumber)
+	}
+	return bitfield.NewFromSet(nums)
+}
+
+// batchByPartition 按 deadline、partition 分组，并切分成每批最多 maxPartitions 个 partition、
+// maxSectors 个扇区的批次；一个 partition 超出剩余容量时会拆到下一批
+func batchByPartition(rows []*sectorPenalty, maxPartitions, maxSectors int) [][]*partitionSectors {
+	groups := make(map[calc.SectorLocation]*partitionSectors)
+	var locs []calc.SectorLocation
+	for _, r := range rows {
+		loc := calc.SectorLocation{Deadline: r.Deadline, Partition: r.Partition}
+		g, ok := groups[loc]
+		if !ok {
+			g = &partitionSectors{SectorLocation: loc}
+			groups[loc] = g
+			locs = append(locs, loc)
+		}
+		g.rows = append(g.rows, r)
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].Deadline != locs[j].Deadline {
+			return locs[i].Deadline < locs[j].Deadline
+		}
+		return locs[i].Partition < locs[j].Partition
+	})
+
+	var batches [][]*partitionSectors
+	var cur []*partitionSectors
+	curSectors := 0
+	for _, loc := range locs {
+		rest := groups[loc].rows
+		sort.Slice(rest, func(i, j int) bool { return rest[i].SectorNumber < rest[j].SectorNumber })
+		for len(rest) > 0 {
+			if len(cur) == maxPartitions || curSectors == maxSectors {
+				batches = append(batches, cur)
+				cur, curSectors = nil, 0
+			}
+			n := min(len(rest), maxSectors-curSectors)
+			cur = append(cur, &partitionSectors{SectorLocation: loc, rows: rest[:n]})
+			curSectors += n
+			rest = rest[n:]
+		}
+	}
+	if len(cur) > 0 {
+		batches = append(batches, cur)
+	}
+	return batches
+}
+
+// parseBatchLimit 读取每批数量限制，不能超过协议上限
+func parseBatchLimit(c *gin.Context, key string, max int) int {
+	v, err := strconv.Atoi(c.Query(key))
+	if err != nil || v <= 0 || v > max {
+		return max
+	}
+	return v
+}
+
+// messageBatch 是一条未签名的矿工消息，只生成不签名
+type messageBatch struct {
+	Message    *types.Message `json:"message"`
+	ParamsHex  string         `json:"params_hex"`
+	Partitions int            `json:"partitions"`
+	Sectors    int            `json:"sectors"`
+}
+
+// newMessageBatch 编码 params 并生成发往矿工 mid 的消息
+func newMessageBatch(mid, from address.Address, method abi.MethodNum, params cbor.Marshaler, batch []*partitionSectors) (*messageBatch, error) {
+	buf := new(bytes.Buffer)
+	if err := params.MarshalCBOR(buf); err != nil {
+		return nil, err
+	}
+	mb := &messageBatch{
+		Message: &types.Message{
+			To:     mid,
+			From:   from,
+			Value:  big.Zero(),
+			Method: method,
+			Params: buf.Bytes(),
+		},
+		ParamsHex:  hex.EncodeToString(buf.Bytes()),
+		Partitions: len(batch),
+	}
+	for _, p := range batch {
+		mb.Sectors += len(p.rows)
+	}
+	return mb, nil
+}
+
+// parseSender 读取 sender= 参数，默认由 worker 发送
+func parseSender(c *gin.Context, worker address.Address) (address.Address, error) {
+	v := c.Query("sender")
+	if v == "" {
+		return worker, nil
+	}
+	from, err := address.NewFromString(v)
+	if err != nil {
+		return address.Undef, fmt.Errorf("invalid sender address")
+	}
+	return from, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/beck-8/sectors_penalty/calc"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gin-gonic/gin"
+)
+
+// chainNotifier 是 lotus 的 ChainNotify，通过 websocket 连接时可用
+type chainNotifier interface {
+	ChainNotify(ctx context.Context) (<-chan []*api.HeadChange, error)
+}
+
+// 轮询链头时最多回溯的高度，超过时只发送新链头
+const maxHeadDiff = 900
+
+// headChanges 订阅链头变化，节点不支持 ChainNotify 时（HTTP 连接或离线模式）改为轮询链头
+// 第一条消息是当前链头
+func headChanges(ctx context.Context, lapi ChainReader) <-chan []*api.HeadChange {
+	if n, ok := lapi.(chainNotifier); ok {
+		ch, err := n.ChainNotify(ctx)
+		if err == nil {
+			return ch
+		}
+		log.Printf("stream: ChainNotify: %v, polling the head instead\n", err)
+	}
+	return pollHeadChanges(ctx, lapi, time.Duration(netProfile.BlockDelay)*time.Second/2)
+}
+
+// pollHeadChanges 每隔 interval 读取链头，与上一个链头比较生成 revert 和 apply
+func pollHeadChanges(ctx context.Context, lapi ChainReader, interval time.Duration) <-chan []*api.HeadChange {
+	out := make(chan []*api.HeadChange)
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var prev *types.TipSet
+		for {
+			ts, err := lapi.ChainHead(ctx)
+			if err != nil {
+				log.Printf("stream: %v\n", err)
+			} else if prev == nil || ts.Key() != prev.Key() {
+				changes := []*api.HeadChange{{Type: store.HCCurrent, Val: ts}}
+				if prev != nil {
+					if changes, err = headDiff(ctx, lapi, prev, ts); err != nil {
+						log.Printf("stream: %v\n", err)
+						changes = []*api.HeadChange{{Type: store.HCApply, Val: ts}}
+					}
+				}
+				select {
+				case out <- changes:
+				case <-ctx.Done():
+					return
+				}
+				prev = ts
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return out
+}
+
+// headDiff 返回从 from 切换到 to 需要回滚和应用的 tipset，与 ChainNotify 的顺序相同
+func headDiff(ctx context.Context, lapi ChainReader, from, to *types.TipSet) ([]*api.HeadChange, error) {
+	var reverts, applies []*types.TipSet
+	var err error
+	for !from.Equals(to) {
+		if len(reverts)+len(applies) > maxHeadDiff {
+			return nil, fmt.Errorf("head moved by more than %d tipsets", maxHeadDiff)
+		}
+		if from.Height() >= to.Height() {
+			reverts = append(reverts, from)
+			if from, err = lapi.ChainGetTipSet(ctx, from.Parents()); err != nil {
+				return nil, err
+			}
+		}
+		if to.Height() > from.Height() {
+			applies = append(applies, to)
+			if to, err = lapi.ChainGetTipSet(ctx, to.Parents()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	changes := make([]*api.HeadChange, 0, len(reverts)+len(applies))
+	for _, ts := range reverts {
+		changes = append(changes, &api.HeadChange{Type: store.HCRevert, Val: ts})
+	}
+	for i := len(applies) - 1; i >= 0; i-- {
+		changes = append(changes, &api.HeadChange{Type: store.HCApply, Val: applies[i]})
+	}
+	return changes, nil
+}
+
+// streamTipSet 是 revert 事件的数据
+type streamTipSet struct {
+	Height abi.ChainEpoch `json:"height"`
+	TipSet string         `json:"tipset"`
+}
+
+// streamHead 是 head 事件的数据
+type streamHead struct {
+	streamTipSet
+	Miners []*streamMiner `json:"miners"`
+}
+
+// streamMiner 是矿工在新链头上的汇总
+type streamMiner struct {
+	Miner    string  `json:"miner"`
+	Sectors  int     `json:"sectors"`
+	Power    float64 `json:"power"`
+	Pledge   string  `json:"pledge"`
+	Penalty  string  `json:"penalty"`
+	DailyFee string  `json:"daily_fee"`
+	// faulty 扇区数和原值算力（TiB）
+	Faults     int     `json:"faults"`
+	FaultPower float64 `json:"fault_power"`
+	// days 天内（含今天）过期的扇区，与 /penalty 的行相同
+	Expiring []*penaltyDay `json:"expiring"`
+}
+
+// computeStreamMiner 计算矿工在 ts 上的汇总
+func computeStreamMiner(ctx context.Context, lapi ChainReader, ts *types.TipSet, mid address.Address, days int) (*streamMiner, error) {
+	rows, ms, err := calc.SectorPenalties(ctx, lapi, ts, mid, calc.PenaltyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	fee, err := calc.MinerDailyFee(ctx, lapi, ts, mid)
+	if err != nil {
+		return nil, err
+	}
+
+	sm := &streamMiner{Miner: mid.String(), DailyFee: toFIL(fee.DailyFee), Expiring: []*penaltyDay{}}
+	for _, p := range ms.Partitions {
+		n, err := p.Faulty.Count()
+		if err != nil {
+			return nil, err
+		}
+		sm.Faults += int(n)
+	}
+	sm.FaultPower = toTiB(big.Mul(big.NewInt(int64(sm.Faults)), big.NewInt(int64(ms.Info.SectorSize))))
+
+	// 按高度范围挑出 days 天内过期的扇区，DATE_FORMAT 带时间时也不会漏掉
+	from, _ := dayEpochs(ts, 0)
+	_, to := dayEpochs(ts, days-1)
+	var upcoming []*calc.SectorPenalty
+	pledge, penalty := big.Zero(), big.Zero()
+	for _, r := range rows {
+		pledge = big.Add(pledge, r.InitialPledge)
+		penalty = big.Add(penalty, r.Penalty)
+		if r.QuantizedExpiration >= from && r.QuantizedExpiration < to {
+			upcoming = append(upcoming, r)
+		}
+	}
+	sm.Sectors = len(rows)
+	sm.Expiring = append(sm.Expiring, newPenaltyDays(sm.Miner, calc.ExpirationsByDay(upcoming, ms.Info.SectorSize, func(epoch abi.ChainEpoch) string {
+		return heightToTime(int64(epoch))
+	}))...)
+	sm.Power = toTiB(big.Mul(big.NewInt(int64(len(rows))), big.NewInt(int64(ms.Info.SectorSize))))
+	sm.Pledge = toFIL(pledge)
+	sm.Penalty = toFIL(penalty)
+	return sm, nil
+}
+
+// penaltyStream 是 /stream，链头变化时推送 miner= 或 owner= 中矿工的最新汇总
+// 事件：head（新链头和矿工汇总）、revert（被回滚的 tipset）、error
+func penaltyStream(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := minerQueryOrAbort(c, true)
+		if !ok {
+			return
+		}
+		days := 7
+		if v := c.Query("days"); v != "" {
+			d, err := strconv.Atoi(v)
+			if err != nil || d <= 0 {
+				c.JSON(http.StatusBadRequest, APIResponse{
+					Code: http.StatusBadRequest,
+					Msg:  "days must be a positive integer",
+				})
+				return
+			}
+			days = d
+		}
+
+		ctx := c.Request.Context()
+		changes := headChanges(ctx, lapi)
+		c.Header("X-Accel-Buffering", "no")
+		c.Stream(func(w io.Writer) bool {
+			var hcs []*api.HeadChange
+			select {
+			case <-ctx.Done():
+				return false
+			case hcs, ok = <-changes:
+				if !ok {
+					c.SSEvent("error", gin.H{"msg": "head subscription closed"})
+					return false
+				}
+			}
+
+			var head *types.TipSet
+			for _, hc := range hcs {
+				switch hc.Type {
+				case store.HCRevert:
+					c.SSEvent("revert", streamTipSet{hc.Val.Height(), hc.Val.Key().String()})
+				case store.HCApply, store.HCCurrent:
+					head = hc.Val
+				}
+			}
+			// 同一批中只计算最新的链头
+			if head != nil {
+				data, err := streamMiners(ctx, lapi, head, q, days)
+				if err != nil {
+					c.SSEvent("error", gin.H{"height": head.Height(), "msg": err.Error()})
+				} else {
+					c.SSEvent("head", data)
+				}
+			}
+			return true
+		})
+	}
+}
+
+func streamMiners(ctx context.Context, lapi ChainReader, ts *types.TipSet, q *minerQuery, days int) (*streamHead, error) {
+	mids, err := q.resolve(ctx, lapi, ts)
+	if err != nil {
+		return nil, err
+	}
+	miners, err := calc.MapMiners(ctx, mids, func(ctx context.Context, mid address.Address) (*streamMiner, error) {
+		return computeStreamMiner(ctx, lapi, ts, mid, days)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &streamHead{streamTipSet{ts.Height(), ts.Key().String()}, miners}, nil
+}
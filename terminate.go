@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	m "github.com/filecoin-project/go-state-types/builtin/v16/miner"
+	"github.com/gin-gonic/gin"
+)
+
+// terminateBatch 是一条未签名的 TerminateSectors 消息
+type terminateBatch struct {
+	*messageBatch
+	Penalty string `json:"penalty"`
+}
+
+type terminateMessages struct {
+	Batches []*terminateBatch `json:"batches"`
+	Penalty string            `json:"penalty"`
+	// 所在 deadline 当前不可变更，不能终结的扇区
+	Skipped []abi.SectorNumber `json:"skipped"`
+}
+
+// penaltyTerminate 为选中的扇区生成 TerminateSectors 消息，只生成不签名
+func penaltyTerminate(lapi ChainReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, ok := formatOrAbort(c, formatCSV)
+		if !ok {
+			return
+		}
+		req, ok := parsePenaltyRequest(lapi, c, false)
+		if !ok {
+			return
+		}
+		// 已经过期或终结的扇区不能再终结
+		req.allSectors = false
+		sel, err := parseSelection(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  err.Error(),
+			})
+			return
+		}
+
+		rows, ms, err := computeSectorPenalties(c.Request.Context(), lapi, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code: http.StatusInternalServerError,
+				Msg:  err.Error(),
+			})
+			return
+		}
+		// 默认由 worker 发送，也可以用 sender= 指定 owner 或控制地址
+		from, err := parseSender(c, ms.Info.Worker)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  err.Error(),
+			})
+			return
+		}
+
+		out := &terminateMessages{}
+		var selected []*sectorPenalty
+		total := big.Zero()
+		for _, r := range rows {
+			if !sel.match(r) {
+				continue
+			}
+			if !deadlineIsMutable(ms.Deadline.PeriodStart, r.Deadline, req.ts.Height()) {
+				out.Skipped = append(out.Skipped, r.SectorNumber)
+				continue
+			}
+			selected = append(selected, r)
+			total = big.Add(total, r.penalty)
+		}
+		if len(selected) == 0 {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code: http.StatusBadRequest,
+				Msg:  "no terminable sectors selected",
+			})
+			return
+		}
+
+		batches := batchByPartition(selected,
+			parseBatchLimit(c, "batch_partitions", m.DeclarationsMax),
+			parseBatchLimit(c, "batch_sectors", m.AddressedSectorsMax))
+		for _, batch := range batches {
+			tb, err := newTerminateBatch(req.mid, from, batch)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, APIResponse{
+					Code: http.StatusInternalServerError,
+					Msg:  err.Error(),
+				})
+				return
+			}
+			out.Batches = append(out.Batches, tb)
+		}
+		out.Penalty = toFIL(total)
+		render(c, req.ts, f, &result{data: out, records: out.Batches, table: out.table()})
+	}
+}
+
+func (out *terminateMessages) table() *table {
+	t := &table{Header: []string{"batch", "partitions", "sectors", "penalty", "from", "to", "method", "params_hex"}}
+	for i, tb := range out.Batches {
+		t.Rows = append(t.Rows, []string{strconv.Itoa(i), strconv.Itoa(tb.Partitions), strconv.Itoa(tb.Sectors), tb.Penalty, tb.Message.From.String(), tb.Message.To.String(), fmt.Sprint(tb.Message.Method), tb.ParamsHex})
+	}
+	// 汇总数据
+	t.Rows = append(t.Rows, []string{strconv.Itoa(len(out.Batches)), "", "", out.Penalty, "", "", "", ""})
+	if len(out.Skipped) > 0 {
+		t.Rows = append(t.Rows, []string{"skipped", strings.Trim(fmt.Sprint(out.Skipped), "[]"), "", "", "", "", "", ""})
+	}
+	return t
+}
+
+// newTerminateBatch 把一批 partition 编码成 TerminateSectorsParams
+func newTerminateBatch(mid, from address.Address, batch []*partitionSectors) (*terminateBatch, error) {
+	params := &m.TerminateSectorsParams{}
+	penalty := big.Zero()
+	for _, p := range batch {
+		params.Terminations = append(params.Terminations, m.TerminationDeclaration{
+			Deadline:  p.Deadline,
+			Partition: p.Partition,
+			Sectors:   p.bitfield(),
+		})
+		for _, r := range p.rows {
+			penalty = big.Add(penalty, r.penalty)
+		}
+	}
+
+	mb, err := newMessageBatch(mid, from, builtin.MethodsMiner.TerminateSectors, params, batch)
+	if err != nil {
+		return nil, err
+	}
+	return &terminateBatch{messageBatch: mb, Penalty: toFIL(penalty)}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/gin-gonic/gin"
+)
+
+// resolveTipSet 解析请求中的 tipset= 或 height= 参数，都没有时使用链头
+func resolveTipSet(ctx context.Context, lapi ChainReader, c *gin.Context) (*types.TipSet, error) {
+	return lookupTipSet(ctx, lapi, c.Query("tipset"), c.Query("height"))
+}
+
+// lookupTipSet 与 resolveTipSet 相同，参数为空字符串时忽略
+func lookupTipSet(ctx context.Context, lapi ChainReader, tss, hs string) (*types.TipSet, error) {
+	if tss != "" {
+		cids, err := lcli.ParseTipSetString(tss)
+		if err != nil {
+			return nil, fmt.Errorf("parse tipset: %w", err)
+		}
+		return lapi.ChainGetTipSet(ctx, types.NewTipSetKey(cids...))
+	}
+	if hs != "" {
+		h, err := strconv.ParseInt(hs, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse height: %w", err)
+		}
+		return lapi.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(h), types.EmptyTSK)
+	}
+	return lapi.ChainHead(ctx)
+}
+
+// tipSetOrAbort 解析失败时直接返回 400
+func tipSetOrAbort(lapi ChainReader, c *gin.Context) (*types.TipSet, bool) {
+	ts, err := resolveTipSet(c.Request.Context(), lapi, c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Code: http.StatusBadRequest,
+			Msg:  err.Error(),
+		})
+		return nil, false
+	}
+	return ts, true
+}
+
+// tipSetHeaders 在响应头中带上计算所用的 tipset，方便复现
+func tipSetHeaders(c *gin.Context, ts *types.TipSet) {
+	c.Header("X-Tipset-Height", strconv.FormatInt(int64(ts.Height()), 10))
+	c.Header("X-Tipset-Key", ts.Key().String())
+}
+
+// dayStartHeight 返回 height 所在日期（本地时区）0点的高度
+func dayStartHeight(height abi.ChainEpoch) abi.ChainEpoch {
+	t := netProfile.timeAt(height)
+	zero := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return netProfile.heightAt(zero)
+}
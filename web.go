@@ -0,0 +1,26 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// web 是 /ui 的页面，只调用 /penalty、/vested、/spdailyfee 和 /dailyfee 的 json=1 接口
+//
+//go:embed web
+var webFiles embed.FS
+
+// serveWeb 注册 /ui，访问 / 时跳转到 /ui/
+func serveWeb(r *gin.Engine) {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	r.StaticFS("/ui", http.FS(sub))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+}
@@ -0,0 +1,287 @@
+// 页面只调用 json=1 接口，所有请求使用第一次请求返回的高度，保证数据一致
+(function () {
+  "use strict";
+
+  var $ = function (id) { return document.getElementById(id); };
+  var COLORS = { pledge: "#2e86de", penalty: "#e74c3c", power: "#27ae60", vested: "#8e44ad", cumulative: "#f39c12" };
+
+  var state = { calendar: [], vested: [], miner: "" };
+
+  function setStatus(msg, isError) {
+    $("status").textContent = msg;
+    $("status").className = isError ? "error" : "";
+  }
+
+  function api(path, params) {
+    var q = new URLSearchParams({ json: "1" });
+    Object.keys(params).forEach(function (k) {
+      if (params[k]) q.set(k, params[k]);
+    });
+    return fetch(path + "?" + q).then(function (resp) {
+      return resp.json().then(function (body) {
+        if (body.code !== 200) throw new Error(path + ": " + body.msg);
+        return body;
+      });
+    });
+  }
+
+  // 多个矿工时接口返回 {miners, combined}，图表使用合并后的行
+  function combined(data) {
+    return Array.isArray(data) ? data : data.combined || [];
+  }
+
+  function num(v) {
+    return typeof v === "number" ? v : parseFloat(v) || 0;
+  }
+
+  function fmt(v, digits) {
+    return num(v).toLocaleString(undefined, { maximumFractionDigits: digits === undefined ? 4 : digits });
+  }
+
+  function el(tag, attrs, text) {
+    var e = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (k) { e.setAttribute(k, attrs[k]); });
+    if (text !== undefined) e.textContent = text;
+    return e;
+  }
+
+  function svg(tag, attrs) {
+    var e = document.createElementNS("http://www.w3.org/2000/svg", tag);
+    Object.keys(attrs || {}).forEach(function (k) { e.setAttribute(k, attrs[k]); });
+    return e;
+  }
+
+  function fillTable(table, header, rows) {
+    table.innerHTML = "";
+    var tr = el("tr");
+    header.forEach(function (h) { tr.appendChild(el("th", {}, h)); });
+    table.appendChild(tr);
+    rows.forEach(function (r) {
+      var tr = el("tr");
+      r.forEach(function (v) { tr.appendChild(el("td", {}, v)); });
+      table.appendChild(tr);
+    });
+  }
+
+  function fillTotals(div, items) {
+    div.innerHTML = "";
+    items.forEach(function (it) {
+      var d = el("div", {}, it[1]);
+      d.insertBefore(el("span", {}, it[0]), d.firstChild);
+      div.appendChild(d);
+    });
+  }
+
+  // chart 画柱状图（bars）和折线（lines），折线使用右侧坐标轴
+  function chart(div, labels, bars, lines) {
+    div.innerHTML = "";
+    var legend = el("div", { "class": "legend" });
+    bars.concat(lines).forEach(function (s) {
+      var item = el("span", {}, s.name);
+      var mark = el("i");
+      mark.style.background = s.color;
+      item.insertBefore(mark, item.firstChild);
+      legend.appendChild(item);
+    });
+    div.appendChild(legend);
+    if (!labels.length) return;
+
+    var W = 1000, H = 280, L = 70, R = lines.length ? 70 : 10, T = 10, B = 40;
+    var root = svg("svg", { viewBox: "0 0 " + W + " " + H, preserveAspectRatio: "none" });
+    var maxOf = function (series) {
+      var m = 0;
+      series.forEach(function (s) { s.values.forEach(function (v) { if (v > m) m = v; }); });
+      return m || 1;
+    };
+    var barMax = maxOf(bars), lineMax = maxOf(lines);
+    var step = (W - L - R) / labels.length;
+    var y = function (v, max) { return H - B - (v / max) * (H - T - B); };
+
+    root.appendChild(svg("line", { x1: L, y1: H - B, x2: W - R, y2: H - B, "class": "axis" }));
+    [[barMax, L - 4, "end"], [lineMax, W - R + 4, "start"]].forEach(function (a, i) {
+      if (i === 1 && !lines.length) return;
+      for (var k = 0; k <= 4; k++) {
+        var t = svg("text", { x: a[1], y: y(a[0] * k / 4, a[0]) + 4, "text-anchor": a[2] });
+        t.textContent = fmt(a[0] * k / 4, 0);
+        root.appendChild(t);
+      }
+    });
+
+    var bw = step / (bars.length + 1);
+    labels.forEach(function (label, i) {
+      bars.forEach(function (s, j) {
+        var v = s.values[i];
+        var r = svg("rect", { x: L + i * step + bw * (j + 0.5), y: y(v, barMax), width: Math.max(bw, 1), height: H - B - y(v, barMax), fill: s.color });
+        var title = svg("title");
+        title.textContent = label + " " + s.name + ": " + fmt(v);
+        r.appendChild(title);
+        root.appendChild(r);
+      });
+    });
+    lines.forEach(function (s) {
+      var pts = s.values.map(function (v, i) { return (L + (i + 0.5) * step) + "," + y(v, lineMax); });
+      root.appendChild(svg("polyline", { points: pts.join(" "), fill: "none", stroke: s.color, "stroke-width": 2, "vector-effect": "non-scaling-stroke" }));
+    });
+
+    // 最多显示约 10 个日期
+    var every = Math.ceil(labels.length / 10);
+    labels.forEach(function (label, i) {
+      if (i % every) return;
+      var t = svg("text", { x: L + (i + 0.5) * step, y: H - B + 16, "text-anchor": "middle" });
+      t.textContent = label;
+      root.appendChild(t);
+    });
+    div.appendChild(root);
+  }
+
+  function fillRange(from, to, dates) {
+    [from, to].forEach(function (sel) {
+      sel.innerHTML = "";
+      dates.forEach(function (d) { sel.appendChild(el("option", { value: d }, d)); });
+    });
+    from.selectedIndex = 0;
+    to.selectedIndex = dates.length - 1;
+  }
+
+  // 选项与行的顺序相同，按下标截取
+  function inRange(rows, from, to) {
+    return rows.slice(from.selectedIndex, to.selectedIndex + 1);
+  }
+
+  function download(name, header, rows) {
+    var lines = [header.join(",")].concat(rows.map(function (r) { return r.join(","); }));
+    var a = el("a", { href: URL.createObjectURL(new Blob([lines.join("\n") + "\n"], { type: "text/csv" })), download: name });
+    document.body.appendChild(a);
+    a.click();
+    a.remove();
+  }
+
+  function calendarRows() {
+    return inRange(state.calendar, $("calendar-from"), $("calendar-to"));
+  }
+
+  function renderCalendar() {
+    var rows = calendarRows();
+    var sum = function (k) { return rows.reduce(function (s, r) { return s + num(r[k]); }, 0); };
+    fillTotals($("calendar-totals"), [
+      ["Sectors", fmt(sum("sectors_sum"), 0)],
+      ["Power (TiB)", fmt(sum("power"))],
+      ["Pledge (FIL)", fmt(sum("pledge"))],
+      ["Penalty (FIL)", fmt(sum("penalty"))]
+    ]);
+    chart($("calendar-chart"), rows.map(function (r) { return r.date; }), [
+      { name: "Pledge (FIL)", color: COLORS.pledge, values: rows.map(function (r) { return num(r.pledge); }) },
+      { name: "Penalty (FIL)", color: COLORS.penalty, values: rows.map(function (r) { return num(r.penalty); }) }
+    ], [
+      { name: "Power (TiB, right axis)", color: COLORS.power, values: rows.map(function (r) { return num(r.power); }) }
+    ]);
+    fillTable($("calendar-table"), ["Date", "Sectors", "Power (TiB)", "Pledge (FIL)", "Penalty (FIL)"], rows.map(function (r) {
+      return [r.date, r.sectors_sum, fmt(r.power), fmt(r.pledge), fmt(r.penalty)];
+    }));
+  }
+
+  function vestedRows() {
+    return inRange(state.vested, $("vested-from"), $("vested-to"));
+  }
+
+  function renderVested() {
+    var rows = vestedRows();
+    var total = 0;
+    var cumulative = rows.map(function (r) { total += num(r.vested_funds); return total; });
+    fillTotals($("vested-totals"), [["Released in range (FIL)", fmt(total)], ["Days", rows.length]]);
+    chart($("vested-chart"), rows.map(function (r) { return r.date; }), [
+      { name: "Daily release (FIL)", color: COLORS.vested, values: rows.map(function (r) { return num(r.vested_funds); }) }
+    ], [
+      { name: "Cumulative (FIL, right axis)", color: COLORS.cumulative, values: cumulative }
+    ]);
+    fillTable($("vested-table"), ["Date", "Released (FIL)", "Cumulative (FIL)"], rows.map(function (r, i) {
+      return [r.date, fmt(r.vested_funds), fmt(cumulative[i])];
+    }));
+  }
+
+  function renderNetworkFee(d) {
+    fillTable($("network-fee"), ["Size (QAP)", "Daily fee (FIL)", "210 days (FIL)", "540 days (FIL)"], d.sizes.map(function (s) {
+      return [s.size, s.daily_fee.fil, s.fee_210.fil, s.fee_540.fil];
+    }));
+  }
+
+  function renderMinerFee(d) {
+    var div = $("miner-fee");
+    div.innerHTML = "";
+    var totals = el("div", { "class": "totals" });
+    fillTotals(totals, [["Daily fee (FIL)", d.daily_fee.fil], ["Until all sectors expire (FIL)", d.total_fee.fil]]);
+    div.appendChild(totals);
+    if (d.miners) {
+      var table = el("table");
+      fillTable(table, ["Miner", "Daily fee (FIL)", "Total fee (FIL)"], d.miners.map(function (m) {
+        return [m.miner, m.daily_fee.fil, m.total_fee.fil];
+      }));
+      div.appendChild(table);
+    }
+  }
+
+  function load(ev) {
+    if (ev) ev.preventDefault();
+    var form = new FormData($("query"));
+    var params = { miner: form.get("miner").trim(), owner: form.get("owner").trim(), height: form.get("height").trim() };
+    history.replaceState(null, "", "?" + new URLSearchParams(params));
+    state.miner = params.owner ? "owner-" + params.owner : params.miner;
+    setStatus("Loading...");
+
+    // 离线模式没有日费，日费失败时只在对应的面板显示错误
+    api("/dailyfee", { height: params.height }).then(function (body) {
+      renderNetworkFee(body.data);
+      // 后续请求固定在同一高度
+      params.height = String(body.height);
+    }, function (err) {
+      fillTable($("network-fee"), [err.message], []);
+    }).then(function () {
+      if (!params.miner && !params.owner) {
+        setStatus("Enter a miner or owner to see its calendar.");
+        return;
+      }
+      return Promise.all([
+        api("/penalty", params),
+        api("/vested", params),
+        api("/spdailyfee", params).catch(function (err) { return { error: err }; })
+      ]).then(function (res) {
+        state.calendar = combined(res[0].data);
+        state.vested = combined(res[1].data);
+        fillRange($("calendar-from"), $("calendar-to"), state.calendar.map(function (r) { return r.date; }));
+        fillRange($("vested-from"), $("vested-to"), state.vested.map(function (r) { return r.date; }));
+        renderCalendar();
+        renderVested();
+        if (res[2].error) {
+          $("miner-fee").textContent = res[2].error.message;
+        } else {
+          renderMinerFee(res[2].data);
+        }
+        ["calendar-section", "vested-section", "miner-fee-section"].forEach(function (id) { $(id).hidden = false; });
+        setStatus("Height " + res[0].height);
+      });
+    }).catch(function (err) {
+      setStatus(err.message, true);
+    });
+  }
+
+  $("query").addEventListener("submit", load);
+  ["calendar-from", "calendar-to"].forEach(function (id) { $(id).addEventListener("change", renderCalendar); });
+  ["vested-from", "vested-to"].forEach(function (id) { $(id).addEventListener("change", renderVested); });
+  $("calendar-csv").addEventListener("click", function () {
+    download(state.miner + "-penalty.csv", ["date", "mid", "sectors_sum", "power(TiB)", "pledge", "penalty"], calendarRows().map(function (r) {
+      return [r.date, r.mid, r.sectors_sum, r.power, r.pledge, r.penalty];
+    }));
+  });
+  $("vested-csv").addEventListener("click", function () {
+    download(state.miner + "-vested.csv", ["Date", "Miner", "VestedFunds(FIL)"], vestedRows().map(function (r) {
+      return [r.date, r.miner, r.vested_funds];
+    }));
+  });
+
+  // 支持 /ui/?miner=f01155 直接打开
+  var initial = new URLSearchParams(location.search);
+  ["miner", "owner", "height"].forEach(function (k) {
+    if (initial.get(k)) $("query").elements[k].value = initial.get(k);
+  });
+  load();
+})();